@@ -17,6 +17,7 @@ var (
 	buildTemplatesDir string
 	buildVariables    []string
 	buildValidate     bool
+	buildStrict       bool
 	buildVerbose      bool
 )
 
@@ -26,21 +27,17 @@ var buildCmd = &cobra.Command{
 	Long: `Generate Kubernetes manifests by processing templates with environment-specific configurations.
 
 This command combines templates with configuration to produce ready-to-deploy Kubernetes manifests.
-Use --validate flag to automatically validate generated manifests after build.`,
+Use --validate flag to automatically validate generated manifests after build.
+Use --strict (or 'strict: true' in the configuration) to fail on undefined template variables.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		// Create output options
 		outputOpts := &output.OutputOptions{Verbose: buildVerbose}
 
 		// Parse command line variables
-		cmdVariables := make(map[string]string)
-		for _, varPair := range buildVariables {
-			parts := strings.SplitN(varPair, "=", 2)
-			if len(parts) != 2 {
-				outputOpts.PrintError("Variable parsing", fmt.Sprintf("Invalid --var format: %s. Expected format: VAR_NAME=VALUE", varPair))
-				os.Exit(1)
-			}
-			cmdVariables[parts[0]] = parts[1]
-			outputOpts.PrintInfo(fmt.Sprintf("Override variable: %s=%s", parts[0], parts[1]))
+		cmdVariables, err := parseVariableOverrides(buildVariables)
+		if err != nil {
+			outputOpts.PrintError("Variable parsing", err.Error())
+			os.Exit(1)
 		}
 
 		options := mikomanifest.BuildOptions{
@@ -49,6 +46,7 @@ Use --validate flag to automatically validate generated manifests after build.`,
 			ConfigDir:    buildConfigDir,
 			TemplatesDir: buildTemplatesDir,
 			Variables:    cmdVariables,
+			Strict:       buildStrict,
 			OutputOpts:   outputOpts,
 		}
 
@@ -76,13 +74,31 @@ Use --validate flag to automatically validate generated manifests after build.`,
 	},
 }
 
+// parseVariableOverrides parses --var NAME=VALUE pairs into typed values
+func parseVariableOverrides(pairs []string) (map[string]interface{}, error) {
+	variables := make(map[string]interface{})
+	for _, varPair := range pairs {
+		parts := strings.SplitN(varPair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid --var format: %s. Expected format: VAR_NAME=VALUE", varPair)
+		}
+		value, err := mikomanifest.ParseVariableValue(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --var %s: %v", parts[0], err)
+		}
+		variables[parts[0]] = value
+	}
+	return variables, nil
+}
+
 func init() {
 	buildCmd.Flags().StringVarP(&buildEnv, "env", "e", "", "Environment configuration to use (required)")
 	buildCmd.Flags().StringVarP(&buildOutputDir, "output-dir", "o", "", "Output directory for generated files (required)")
 	buildCmd.Flags().StringVarP(&buildConfigDir, "config", "c", "config", "Configuration directory path")
 	buildCmd.Flags().StringVarP(&buildTemplatesDir, "templates", "t", "templates", "Templates directory path")
-	buildCmd.Flags().StringSliceVarP(&buildVariables, "var", "", []string{}, "Override variables in format: --var VAR_NAME=VALUE")
+	buildCmd.Flags().StringArrayVarP(&buildVariables, "var", "", []string{}, "Override variables in format: --var VAR_NAME=VALUE (lists and maps as [a, b] or {k: v})")
 	buildCmd.Flags().BoolVar(&buildValidate, "validate", false, "Run validation after build using schemas from environment config")
+	buildCmd.Flags().BoolVar(&buildStrict, "strict", false, "Fail when templates use undefined variables, reporting all of them")
 	buildCmd.Flags().BoolVar(&buildVerbose, "verbose", false, "Show detailed build and validation information")
 
 	// Mark required flags - ignore errors as they're only for documentation purposes
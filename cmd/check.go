@@ -10,6 +10,7 @@ import (
 )
 
 var checkConfigDir string
+var checkEnvironments []string
 var checkVerbose bool
 
 var checkCmd = &cobra.Command{
@@ -21,12 +22,17 @@ This command checks the syntax and structure of your configuration files to ensu
 valid before running 'build'. It validates:
   - YAML syntax in configuration files
   - Configuration structure and required fields
-  - Variable definitions and references`,
+  - Variable definitions and references
+  - Variables of each environment against their 'declare' section
+
+Environments are the top-level files not used as a resource by another file;
+use --env to check specific ones.`,
 	Run: func(cmd *cobra.Command, args []string) {
 		outputOpts := output.NewOutputOptions(checkVerbose)
 		options := mikomanifest.CheckOptions{
-			ConfigDir:  checkConfigDir,
-			OutputOpts: outputOpts,
+			ConfigDir:    checkConfigDir,
+			Environments: checkEnvironments,
+			OutputOpts:   outputOpts,
 		}
 
 		if err := mikomanifest.CheckConfigDirectory(options); err != nil {
@@ -38,5 +44,6 @@ valid before running 'build'. It validates:
 
 func init() {
 	checkCmd.Flags().StringVarP(&checkConfigDir, "config", "c", "config", "Configuration directory path")
+	checkCmd.Flags().StringArrayVarP(&checkEnvironments, "env", "e", []string{}, "Environment to check (repeatable, defaults to all detected environments)")
 	checkCmd.Flags().BoolVarP(&checkVerbose, "verbose", "v", false, "Show detailed processing information")
 }
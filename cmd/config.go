@@ -3,6 +3,7 @@ package cmd
 import (
 	"fmt"
 	"path/filepath"
+	"strings"
 
 	"github.com/jepemo/miko-manifest/pkg/mikomanifest"
 	"github.com/jepemo/miko-manifest/pkg/output"
@@ -20,6 +21,9 @@ Use this command to inspect and understand your configuration structure before b
 
 Options:
   --variables: Show only variables in key=value format
+  --provenance: With --variables, annotate each value with the file and line that set it
+  --explain VAR: Show the final value of VAR and every layer that set or overrode it
+  --var NAME=VALUE: Apply the same overrides as 'build --var'
   --schemas: Show list of schema definitions
   --tree: Show configuration tree structure`,
 	RunE: runConfig,
@@ -30,6 +34,9 @@ type ConfigOptions struct {
 	ConfigDir   string
 	ShowTree    bool
 	Variables   bool
+	Provenance  bool
+	Explain     string
+	Vars        []string
 	Schemas     bool
 	Verbose     bool
 }
@@ -41,6 +48,9 @@ func init() {
 	configCmd.Flags().StringVarP(&configOptions.ConfigDir, "config", "c", "config", "Configuration directory path")
 	configCmd.Flags().BoolVar(&configOptions.ShowTree, "tree", false, "Show the hierarchy of included resources")
 	configCmd.Flags().BoolVar(&configOptions.Variables, "variables", false, "Show only variables in format: var=value")
+	configCmd.Flags().BoolVar(&configOptions.Provenance, "provenance", false, "With --variables, show where each value was set")
+	configCmd.Flags().StringVar(&configOptions.Explain, "explain", "", "Show the override chain of a single variable")
+	configCmd.Flags().StringArrayVar(&configOptions.Vars, "var", []string{}, "Override variables in format: --var VAR_NAME=VALUE")
 	configCmd.Flags().BoolVar(&configOptions.Schemas, "schemas", false, "Show list of all schemas")
 	configCmd.Flags().BoolVarP(&configOptions.Verbose, "verbose", "v", false, "Enable verbose output")
 
@@ -56,29 +66,33 @@ func runConfig(cmd *cobra.Command, args []string) error {
 	// Create output options
 	outputOpts := &output.OutputOptions{Verbose: configOptions.Verbose}
 
+	overrides, err := parseVariableOverrides(configOptions.Vars)
+	if err != nil {
+		return err
+	}
+
 	// Display based on requested format
 	if configOptions.ShowTree {
-		return displayConfigTreeWithLoading(configOptions.ConfigDir, configOptions.Environment, outputOpts)
+		return displayConfigTreeWithLoading(configOptions.ConfigDir, configOptions.Environment, overrides, outputOpts)
+	}
+
+	// Load the configuration without verbose tree display
+	config, err := mikomanifest.LoadConfig(configOptions.ConfigDir, configOptions.Environment, false)
+	if err != nil {
+		return fmt.Errorf("failed to load configuration: %v", err)
+	}
+	mikomanifest.ApplyVariableOverrides(config, overrides)
+	if err := mikomanifest.ResolveConfigVariables(config); err != nil {
+		return fmt.Errorf("failed to resolve variables: %v", config.RedactError(err))
+	}
+
+	if configOptions.Explain != "" {
+		return displayVariableExplain(config, configOptions.Explain, outputOpts)
 	} else if configOptions.Variables {
-		// Load the configuration without verbose tree display
-		config, err := mikomanifest.LoadConfig(configOptions.ConfigDir, configOptions.Environment, false)
-		if err != nil {
-			return fmt.Errorf("failed to load configuration: %v", err)
-		}
-		return displayVariables(config, outputOpts)
+		return displayVariables(config, configOptions.Provenance, outputOpts)
 	} else if configOptions.Schemas {
-		// Load the configuration without verbose tree display
-		config, err := mikomanifest.LoadConfig(configOptions.ConfigDir, configOptions.Environment, false)
-		if err != nil {
-			return fmt.Errorf("failed to load configuration: %v", err)
-		}
 		return displaySchemas(config, outputOpts)
 	} else {
-		// Load the configuration without verbose tree display
-		config, err := mikomanifest.LoadConfig(configOptions.ConfigDir, configOptions.Environment, false)
-		if err != nil {
-			return fmt.Errorf("failed to load configuration: %v", err)
-		}
 		return displayFullConfig(config, outputOpts)
 	}
 }
@@ -87,6 +101,9 @@ func (opts *ConfigOptions) Validate() error {
 	if opts.Environment == "" {
 		return fmt.Errorf("environment is required")
 	}
+	if opts.Provenance && !opts.Variables {
+		return fmt.Errorf("--provenance can only be used with --variables")
+	}
 	return nil
 }
 
@@ -113,29 +130,81 @@ func displayFullConfig(config *mikomanifest.Config, outputOpts *output.OutputOpt
 		fmt.Println("variables:")
 		for _, variable := range config.Variables {
 			fmt.Printf("  - name: %s\n", variable.Name)
-			fmt.Printf("    value: %s\n", variable.Value)
+			if variable.ValueFrom != nil {
+				fmt.Printf("    value: %s # from %s\n", variable.DisplayValue(), variable.ValueFrom)
+			} else {
+				fmt.Printf("    value: %s\n", variable.DisplayValue())
+			}
 		}
 		fmt.Println()
 	}
 
 	// Show includes
 	if len(config.Include) > 0 {
+		variables := config.DeclaredValues()
 		fmt.Println("include:")
 		for _, include := range config.Include {
-			fmt.Printf("  - file: %s\n", include.File)
+			if include.ID != "" {
+				fmt.Printf("  - id: %s\n    file: %s\n", include.ID, include.File)
+			} else {
+				fmt.Printf("  - file: %s\n", include.File)
+			}
+			if include.When != "" {
+				enabled, err := include.Enabled(variables)
+				if err != nil {
+					return config.RedactError(err)
+				}
+				fmt.Printf("    when: %q%s\n", include.When, skippedNote(enabled))
+			}
+			if len(include.Exclude) > 0 {
+				fmt.Printf("    exclude: [%s]\n", strings.Join(include.Exclude, ", "))
+			}
+			if !include.Rendered() {
+				fmt.Printf("    render: false\n")
+			}
+			if len(include.Delims) > 0 {
+				fmt.Printf("    delims: [%q, %q]\n", include.Delims[0], include.Delims[1])
+			}
+			if include.Output != "" {
+				fmt.Printf("    output: %q\n", include.Output)
+			}
+			if len(include.Variables) > 0 {
+				fmt.Printf("    variables:\n")
+				for _, variable := range include.Variables {
+					fmt.Printf("      - name: %s\n", variable.Name)
+					fmt.Printf("        value: %s\n", variable.DisplayValue())
+				}
+			}
 			if include.Repeat != "" {
 				fmt.Printf("    repeat: %s\n", include.Repeat)
+				if include.ChildRepeat != "" {
+					fmt.Printf("    childRepeat: %s\n", include.ChildRepeat)
+				}
+				if include.Matrix != nil {
+					displayMatrix(include.Matrix)
+				}
+				if include.ListFrom != nil {
+					fmt.Printf("    listFrom: %s\n", include.ListFrom)
+				}
 				if len(include.List) > 0 {
 					fmt.Printf("    list:\n")
 					for _, item := range include.List {
 						fmt.Printf("      - key: %s\n", item.Key)
+						if item.When != "" {
+							enabled, err := include.ItemEnabled(item, variables)
+							if err != nil {
+								return config.RedactError(err)
+							}
+							fmt.Printf("        when: %q%s\n", item.When, skippedNote(enabled))
+						}
 						if len(item.Values) > 0 {
 							fmt.Printf("        values:\n")
 							for _, value := range item.Values {
 								fmt.Printf("          - name: %s\n", value.Name)
-								fmt.Printf("            value: %s\n", value.Value)
+								fmt.Printf("            value: %s\n", value.DisplayValue())
 							}
 						}
+						displayChildren(item.Children, "        ")
 					}
 				}
 			}
@@ -153,7 +222,7 @@ func displayFullConfig(config *mikomanifest.Config, outputOpts *output.OutputOpt
 	return nil
 }
 
-func displayConfigTreeWithLoading(configDir, environment string, outputOpts *output.OutputOptions) error {
+func displayConfigTreeWithLoading(configDir, environment string, overrides map[string]interface{}, outputOpts *output.OutputOptions) error {
 	outputOpts.PrintStep(fmt.Sprintf("Loading configuration hierarchy for environment: %s", environment))
 	outputOpts.PrintInfo(fmt.Sprintf("Config directory: %s", configDir))
 
@@ -162,6 +231,10 @@ func displayConfigTreeWithLoading(configDir, environment string, outputOpts *out
 	if err != nil {
 		return fmt.Errorf("failed to load configuration: %v", err)
 	}
+	mikomanifest.ApplyVariableOverrides(config, overrides)
+	if err := mikomanifest.ResolveConfigVariables(config); err != nil {
+		return fmt.Errorf("failed to resolve variables: %v", config.RedactError(err))
+	}
 
 	outputOpts.PrintInfo(fmt.Sprintf("Configuration hierarchy for environment: %s", environment))
 
@@ -190,15 +263,16 @@ func displayConfigTree(config *mikomanifest.Config, outputOpts *output.OutputOpt
 		fmt.Println("|-- variables:")
 		for i, variable := range config.Variables {
 			if i == len(config.Variables)-1 && len(config.Include) == 0 {
-				fmt.Printf("    |-- %s=%s\n", variable.Name, variable.Value)
+				fmt.Printf("    |-- %s=%s\n", variable.Name, variable.DisplayValue())
 			} else {
-				fmt.Printf("    |-- %s=%s\n", variable.Name, variable.Value)
+				fmt.Printf("    |-- %s=%s\n", variable.Name, variable.DisplayValue())
 			}
 		}
 	}
 
 	// Show includes
 	if len(config.Include) > 0 {
+		variables := config.DeclaredValues()
 		fmt.Println("|-- templates:")
 		for i, include := range config.Include {
 			if i == len(config.Include)-1 {
@@ -206,17 +280,128 @@ func displayConfigTree(config *mikomanifest.Config, outputOpts *output.OutputOpt
 			} else {
 				fmt.Printf("    |-- %s", include.File)
 			}
+			if include.ID != "" {
+				fmt.Printf(" (id: %s)", include.ID)
+			}
 			if include.Repeat != "" {
 				fmt.Printf(" (repeat: %s)", include.Repeat)
 			}
-			fmt.Println()
+			if !include.Rendered() {
+				fmt.Printf(" (raw)")
+			}
+			note, err := treeSkippedNote(include, variables)
+			if err != nil {
+				return config.RedactError(err)
+			}
+			fmt.Printf("%s\n", note)
+			items := include.List
+			if include.Matrix != nil {
+				if items, err = include.Matrix.Items(); err != nil {
+					return fmt.Errorf("%s: %w", include.Name(), err)
+				}
+			}
+			for _, item := range items {
+				fmt.Printf("        |-- %s\n", item.Key)
+				for _, child := range item.Children {
+					fmt.Printf("            |-- %s\n", child.Key)
+				}
+			}
+		}
+	}
+
+	// Show what the layers removed from their resources
+	if len(config.Removed) > 0 {
+		fmt.Println("|-- removed:")
+		for _, removal := range config.Removed {
+			if rel, err := filepath.Rel(config.ConfigDir, removal.Layer); err == nil {
+				removal.Layer = filepath.ToSlash(rel)
+			}
+			fmt.Printf("    |-- %s\n", removal)
 		}
 	}
 
 	return nil
 }
 
-func displayVariables(config *mikomanifest.Config, outputOpts *output.OutputOptions) error {
+// displayMatrix prints the axes and excluded combinations of a matrix include
+func displayMatrix(matrix *mikomanifest.Matrix) {
+	fmt.Printf("    matrix:\n")
+	fmt.Printf("      output: %s\n", matrix.OutputMode())
+	fmt.Printf("      axes:\n")
+	for _, axis := range matrix.Axes {
+		values := make([]string, len(axis.Values))
+		for i, value := range axis.Values {
+			values[i] = mikomanifest.FormatVariableValue(value)
+		}
+		fmt.Printf("        - name: %s\n", axis.Name)
+		fmt.Printf("          values: [%s]\n", strings.Join(values, ", "))
+	}
+	if len(matrix.Exclude) > 0 {
+		fmt.Printf("      exclude:\n")
+		for _, combination := range matrix.Exclude {
+			fmt.Printf("        - %s\n", mikomanifest.FormatVariableValue(combination))
+		}
+	}
+}
+
+// displayChildren prints the nested items of a repeat item at the given indent
+func displayChildren(children []mikomanifest.ListItem, indent string) {
+	if len(children) == 0 {
+		return
+	}
+	fmt.Printf("%schildren:\n", indent)
+	for _, child := range children {
+		fmt.Printf("%s  - key: %s\n", indent, child.Key)
+		if child.When != "" {
+			fmt.Printf("%s    when: %q\n", indent, child.When)
+		}
+		if len(child.Values) > 0 {
+			fmt.Printf("%s    values:\n", indent)
+			for _, value := range child.Values {
+				fmt.Printf("%s      - name: %s\n", indent, value.Name)
+				fmt.Printf("%s        value: %s\n", indent, value.DisplayValue())
+			}
+		}
+		displayChildren(child.Children, indent+"    ")
+	}
+}
+
+// skippedNote marks a when condition that leaves its include or item out of the build
+func skippedNote(enabled bool) string {
+	if enabled {
+		return ""
+	}
+	return "  # skipped: condition is false"
+}
+
+// treeSkippedNote tells whether an include, or some of its repeat items,
+// are left out of the build by their when conditions
+func treeSkippedNote(include mikomanifest.Include, variables map[string]interface{}) (string, error) {
+	enabled, err := include.Enabled(variables)
+	if err != nil {
+		return "", err
+	}
+	if !enabled {
+		return fmt.Sprintf(" (skipped: when %s is false)", include.When), nil
+	}
+
+	skipped := 0
+	for _, item := range include.List {
+		enabled, err := include.ItemEnabled(item, variables)
+		if err != nil {
+			return "", err
+		}
+		if !enabled {
+			skipped++
+		}
+	}
+	if skipped > 0 {
+		return fmt.Sprintf(" (%d of %d item(s) skipped)", skipped, len(include.List)), nil
+	}
+	return "", nil
+}
+
+func displayVariables(config *mikomanifest.Config, provenance bool, outputOpts *output.OutputOptions) error {
 	if outputOpts.Verbose {
 		outputOpts.PrintStep(fmt.Sprintf("Displaying variables for environment: %s", config.Environment))
 	}
@@ -231,7 +416,58 @@ func displayVariables(config *mikomanifest.Config, outputOpts *output.OutputOpti
 	}
 
 	for _, variable := range config.Variables {
-		fmt.Printf("%s=%s\n", variable.Name, variable.Value)
+		if !provenance {
+			fmt.Printf("%s=%s\n", variable.Name, variable.DisplayValue())
+			continue
+		}
+		fmt.Printf("%s=%s  # %s\n", variable.Name, variable.DisplayValue(), formatProvenance(variable.Origins))
+	}
+
+	return nil
+}
+
+// formatProvenance describes the last origin of a variable and the ones it overrode
+func formatProvenance(origins []mikomanifest.VariableOrigin) string {
+	if len(origins) == 0 {
+		return "unknown origin"
+	}
+
+	last := origins[len(origins)-1]
+	if len(origins) == 1 {
+		return last.String()
+	}
+
+	overridden := make([]string, 0, len(origins)-1)
+	for i := len(origins) - 2; i >= 0; i-- {
+		overridden = append(overridden, origins[i].String())
+	}
+	return fmt.Sprintf("%s (overrides %s)", last, strings.Join(overridden, ", "))
+}
+
+func displayVariableExplain(config *mikomanifest.Config, name string, outputOpts *output.OutputOptions) error {
+	if outputOpts.Verbose {
+		outputOpts.PrintStep(fmt.Sprintf("Explaining variable %s for environment: %s", name, config.Environment))
+	}
+
+	variable, found := config.FindVariable(name)
+	if !found {
+		return fmt.Errorf("variable %s is not defined in environment %s", name, config.Environment)
+	}
+
+	fmt.Printf("%s=%s\n", variable.Name, variable.DisplayValue())
+	if declaration, declared := config.FindDeclaration(name); declared && declaration.Description != "" {
+		fmt.Printf("  %-13s %s\n", "description", declaration.Description)
+	}
+	for i, origin := range variable.Origins {
+		action := "overridden by"
+		if i == 0 {
+			action = "declared in"
+		}
+		value := mikomanifest.MaskedValue
+		if !variable.Sensitive {
+			value = mikomanifest.FormatVariableValue(origin.Value)
+		}
+		fmt.Printf("  %-13s %s: %s\n", action, origin, value)
 	}
 
 	return nil
@@ -0,0 +1,391 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jepemo/miko-manifest/pkg/mikomanifest"
+	"github.com/jepemo/miko-manifest/pkg/output"
+)
+
+// captureStdout returns everything fn prints to stdout
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stdout = w
+
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r)
+		done <- buf.String()
+	}()
+
+	fn()
+
+	_ = w.Close()
+	os.Stdout = oldStdout
+	return <-done
+}
+
+// writeConfigFiles creates config files in a temporary config directory
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	t.Helper()
+
+	configDir := filepath.Join(t.TempDir(), "config")
+	for name, content := range files {
+		path := filepath.Join(configDir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("Failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	return configDir
+}
+
+func TestDisplayFullConfigIsDeterministic(t *testing.T) {
+	configDir := writeConfigFiles(t, map[string]string{
+		"base.yaml": `variables:
+  - name: a
+    value: "1"
+  - name: b
+    value: "2"
+  - name: c
+    value: "3"
+  - name: d
+    value: "4"
+include:
+  - file: one.yaml
+  - file: two.yaml
+  - file: three.yaml
+`,
+		"dev.yaml": `resources:
+  - base.yaml
+variables:
+  - name: c
+    value: "30"
+  - name: e
+    value: "5"
+include:
+  - file: four.yaml
+`,
+	})
+
+	outputOpts := &output.OutputOptions{}
+	var first string
+	for run := 0; run < 10; run++ {
+		config, err := mikomanifest.LoadConfig(configDir, "dev", false)
+		if err != nil {
+			t.Fatalf("Failed to load config: %v", err)
+		}
+
+		out := captureStdout(t, func() {
+			if err := displayFullConfig(config, outputOpts); err != nil {
+				t.Errorf("displayFullConfig failed: %v", err)
+			}
+		})
+
+		if run == 0 {
+			first = out
+			continue
+		}
+		if out != first {
+			t.Fatalf("Run %d: output differs:\n%s\nvs:\n%s", run, first, out)
+		}
+	}
+
+	expectedOrder := []string{"name: a", "name: b", "name: c", "value: 30", "name: d", "name: e", "file: one.yaml", "file: two.yaml", "file: three.yaml", "file: four.yaml"}
+	position := 0
+	for _, expected := range expectedOrder {
+		idx := bytes.Index([]byte(first[position:]), []byte(expected))
+		if idx < 0 {
+			t.Fatalf("Expected %q after position %d in output:\n%s", expected, position, first)
+		}
+		position += idx + len(expected)
+	}
+}
+
+func TestDisplayVariableProvenance(t *testing.T) {
+	configDir := writeConfigFiles(t, map[string]string{
+		"base.yaml": `variables:
+  - name: tag
+    value: latest
+`,
+		"dev.yaml": `resources:
+  - base.yaml
+variables:
+  - name: tag
+    value: dev
+`,
+	})
+
+	config, err := mikomanifest.LoadConfig(configDir, "dev", false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	mikomanifest.ApplyVariableOverrides(config, map[string]interface{}{"tag": "ci"})
+
+	basePath := filepath.Join(configDir, "base.yaml")
+	devPath := filepath.Join(configDir, "dev.yaml")
+	outputOpts := &output.OutputOptions{}
+
+	out := captureStdout(t, func() {
+		if err := displayVariables(config, true, outputOpts); err != nil {
+			t.Errorf("displayVariables failed: %v", err)
+		}
+	})
+	expected := "tag=ci  # --var (overrides " + devPath + ":4, " + basePath + ":2)\n"
+	if out != expected {
+		t.Errorf("Expected %q, got %q", expected, out)
+	}
+
+	out = captureStdout(t, func() {
+		if err := displayVariableExplain(config, "tag", outputOpts); err != nil {
+			t.Errorf("displayVariableExplain failed: %v", err)
+		}
+	})
+	expected = "tag=ci\n" +
+		"  declared in   " + basePath + ":2: latest\n" +
+		"  overridden by " + devPath + ":4: dev\n" +
+		"  overridden by --var: ci\n"
+	if out != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, out)
+	}
+
+	if err := displayVariableExplain(config, "missing", outputOpts); err == nil {
+		t.Error("Expected error for undefined variable, got nil")
+	}
+}
+
+func TestDisplaySkippedIncludes(t *testing.T) {
+	configDir := writeConfigFiles(t, map[string]string{
+		"dev.yaml": `variables:
+  - name: hpa_enabled
+    value: false
+include:
+  - file: deployment.yaml
+  - file: hpa.yaml
+    when: "{{ .hpa_enabled }}"
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+      - key: debug
+        when: '{{ ne .key_name "debug" }}'
+        values:
+          - name: key_name
+            value: debug
+`,
+	})
+
+	config, err := mikomanifest.LoadConfig(configDir, "dev", false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	outputOpts := &output.OutputOptions{}
+
+	out := captureStdout(t, func() {
+		if err := displayFullConfig(config, outputOpts); err != nil {
+			t.Errorf("displayFullConfig failed: %v", err)
+		}
+	})
+	for _, expected := range []string{
+		"  - file: hpa.yaml\n    when: \"{{ .hpa_enabled }}\"  # skipped: condition is false\n",
+		"      - key: debug\n        when: \"{{ ne .key_name \\\"debug\\\" }}\"  # skipped: condition is false\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected output to contain %q, got:\n%s", expected, out)
+		}
+	}
+
+	out = captureStdout(t, func() {
+		if err := displayConfigTree(config, outputOpts); err != nil {
+			t.Errorf("displayConfigTree failed: %v", err)
+		}
+	})
+	for _, expected := range []string{
+		"    |-- deployment.yaml\n",
+		"    |-- hpa.yaml (skipped: when {{ .hpa_enabled }} is false)\n",
+		"    |-- service.yaml (repeat: multiple-files) (1 of 2 item(s) skipped)\n        |-- api\n        |-- debug\n",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected tree to contain %q, got:\n%s", expected, out)
+		}
+	}
+}
+
+func TestDisplayRemovals(t *testing.T) {
+	configDir := writeConfigFiles(t, map[string]string{
+		"base/common.yaml": `variables:
+  - name: debug_port
+    value: 9000
+include:
+  - file: debug.yaml
+`,
+		"prod.yaml": `resources:
+  - base/
+exclude:
+  include: [debug.yaml]
+variables:
+  - name: debug_port
+    $delete: true
+`,
+	})
+
+	config, err := mikomanifest.LoadConfig(configDir, "prod", false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+
+	out := captureStdout(t, func() {
+		if err := displayConfigTree(config, &output.OutputOptions{}); err != nil {
+			t.Errorf("displayConfigTree failed: %v", err)
+		}
+	})
+	expected := "|-- removed:\n" +
+		"    |-- variable debug_port (removed by prod.yaml)\n" +
+		"    |-- include debug.yaml (removed by prod.yaml)\n"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected tree to contain:\n%s\nGot:\n%s", expected, out)
+	}
+}
+
+func TestDisplayMatrixInclude(t *testing.T) {
+	configDir := writeConfigFiles(t, map[string]string{
+		"dev.yaml": `include:
+  - file: cronjob.yaml
+    repeat: matrix
+    matrix:
+      axes:
+        - name: region
+          values: [eu, us]
+        - name: tenant
+          values: [acme, globex]
+      exclude:
+        - { region: us, tenant: acme }
+`,
+	})
+
+	config, err := mikomanifest.LoadConfig(configDir, "dev", false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	outputOpts := &output.OutputOptions{}
+
+	out := captureStdout(t, func() {
+		if err := displayFullConfig(config, outputOpts); err != nil {
+			t.Errorf("displayFullConfig failed: %v", err)
+		}
+	})
+	expected := "    repeat: matrix\n    matrix:\n      output: multiple-files\n      axes:\n" +
+		"        - name: region\n          values: [eu, us]\n" +
+		"        - name: tenant\n          values: [acme, globex]\n" +
+		"      exclude:\n        - {\"region\":\"us\",\"tenant\":\"acme\"}\n"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected output to contain:\n%s\nGot:\n%s", expected, out)
+	}
+
+	out = captureStdout(t, func() {
+		if err := displayConfigTree(config, outputOpts); err != nil {
+			t.Errorf("displayConfigTree failed: %v", err)
+		}
+	})
+	expected = "    |-- cronjob.yaml (repeat: matrix)\n        |-- eu-acme\n        |-- eu-globex\n        |-- us-globex\n"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected tree to contain:\n%s\nGot:\n%s", expected, out)
+	}
+}
+
+func TestDisplayNestedRepeat(t *testing.T) {
+	configDir := writeConfigFiles(t, map[string]string{
+		"dev.yaml": `include:
+  - file: queues.yaml
+    repeat: multiple-files
+    childRepeat: same-file
+    list:
+      - key: acme
+        children:
+          - key: orders
+            values:
+              - name: durable
+                value: true
+          - key: audit
+`,
+	})
+
+	config, err := mikomanifest.LoadConfig(configDir, "dev", false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	outputOpts := &output.OutputOptions{}
+
+	out := captureStdout(t, func() {
+		if err := displayFullConfig(config, outputOpts); err != nil {
+			t.Errorf("displayFullConfig failed: %v", err)
+		}
+	})
+	expected := "    repeat: multiple-files\n    childRepeat: same-file\n    list:\n      - key: acme\n" +
+		"        children:\n          - key: orders\n            values:\n              - name: durable\n                value: true\n" +
+		"          - key: audit\n"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected output to contain:\n%s\nGot:\n%s", expected, out)
+	}
+
+	out = captureStdout(t, func() {
+		if err := displayConfigTree(config, outputOpts); err != nil {
+			t.Errorf("displayConfigTree failed: %v", err)
+		}
+	})
+	expected = "    |-- queues.yaml (repeat: multiple-files)\n        |-- acme\n            |-- orders\n            |-- audit\n"
+	if !strings.Contains(out, expected) {
+		t.Errorf("Expected tree to contain:\n%s\nGot:\n%s", expected, out)
+	}
+}
+
+func TestDisplayConditionsWithLiteralReferences(t *testing.T) {
+	t.Setenv("MIKO_TEST_PASSWORD", "ab${zz}cd")
+	configDir := writeConfigFiles(t, map[string]string{
+		"dev.yaml": `variables:
+  - name: password
+    valueFrom:
+      env: MIKO_TEST_PASSWORD
+include:
+  - file: secret.yaml
+    repeat: same-file
+    list:
+      - key: db
+        when: '{{ ne .password "" }}'
+`,
+	})
+
+	config, err := mikomanifest.LoadConfig(configDir, "dev", false)
+	if err != nil {
+		t.Fatalf("Failed to load config: %v", err)
+	}
+	if err := mikomanifest.ResolveConfigVariables(config); err != nil {
+		t.Fatalf("Failed to resolve variables: %v", err)
+	}
+	outputOpts := &output.OutputOptions{}
+
+	out := captureStdout(t, func() {
+		if err := displayFullConfig(config, outputOpts); err != nil {
+			t.Errorf("displayFullConfig failed: %v", err)
+		}
+		if err := displayConfigTree(config, outputOpts); err != nil {
+			t.Errorf("displayConfigTree failed: %v", err)
+		}
+	})
+	if !strings.Contains(out, "        when: \"{{ ne .password \\\"\\\" }}\"\n") || strings.Contains(out, "skipped") {
+		t.Errorf("Expected the item condition to hold, got:\n%s", out)
+	}
+}
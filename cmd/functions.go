@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/jepemo/miko-manifest/pkg/mikomanifest"
+	"github.com/spf13/cobra"
+)
+
+var functionsCategory string
+
+var functionsCmd = &cobra.Command{
+	Use:   "functions",
+	Short: "List the functions available in templates",
+	Long: `List the functions that can be used in templates, grouped by category.
+
+Names and argument order follow sprig where a sprig function exists, and the
+value is the last argument so it can be piped: {{ .app_name | upper | quote }}.
+The Go template built-ins (printf, len, index, eq, and, or...) are available too.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return listFunctions(functionsCategory)
+	},
+}
+
+func init() {
+	functionsCmd.Flags().StringVar(&functionsCategory, "category", "", "Only list the functions of a category")
+}
+
+// listFunctions prints the template functions, one block per category
+func listFunctions(category string) error {
+	current := ""
+	found := false
+	for _, f := range mikomanifest.TemplateFunctions() {
+		if category != "" && f.Category != category {
+			continue
+		}
+		if f.Category != current {
+			if current != "" {
+				fmt.Println()
+			}
+			fmt.Printf("%s:\n", f.Category)
+			current = f.Category
+		}
+		fmt.Printf("  %-42s %s\n", f.Usage, f.Description)
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("unknown function category: %s", category)
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jepemo/miko-manifest/pkg/mikomanifest"
+)
+
+func TestListFunctions(t *testing.T) {
+	out := captureStdout(t, func() {
+		if err := listFunctions(""); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	})
+	for _, f := range mikomanifest.TemplateFunctions() {
+		if !strings.Contains(out, f.Usage) {
+			t.Errorf("Expected function %s to be listed", f.Name)
+		}
+	}
+
+	out = captureStdout(t, func() {
+		if err := listFunctions(mikomanifest.CategoryEncoding); err != nil {
+			t.Fatalf("Expected no error, got: %v", err)
+		}
+	})
+	if !strings.HasPrefix(out, "encoding:\n") || !strings.Contains(out, "b64enc STRING") || strings.Contains(out, "upper") {
+		t.Errorf("Expected only encoding functions, got:\n%s", out)
+	}
+
+	if err := listFunctions("unknown"); err == nil {
+		t.Error("Expected an error for an unknown category")
+	}
+}
@@ -54,5 +54,9 @@ Use "{{.CommandPath}} [command] --help" for more information about a command.
 	rootCmd.AddCommand(validateCmd)
 	rootCmd.AddCommand(checkCmd)
 	rootCmd.AddCommand(configCmd)
+	rootCmd.AddCommand(encryptCmd)
+	rootCmd.AddCommand(decryptCmd)
+	rootCmd.AddCommand(editCmd)
+	rootCmd.AddCommand(functionsCmd)
 	rootCmd.AddCommand(versionCmd)
 }
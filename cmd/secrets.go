@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/jepemo/miko-manifest/pkg/mikomanifest"
+	"github.com/jepemo/miko-manifest/pkg/output"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+// encryptCmd represents the encrypt command
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt FILE",
+	Short: "Encrypt a configuration file for age recipients",
+	Long: `Encrypt a configuration file in the SOPS format so secrets can be committed.
+
+Only the values of keys matching --encrypted-regex are encrypted (by default the
+"value" of each variable), so variable names stay readable in diffs. Encrypted
+files can be listed in 'resources:' and are decrypted transparently when loading
+the configuration.
+
+Recipients default to the public keys of the local age identity
+(MIKO_AGE_KEY, MIKO_AGE_KEY_FILE or ~/.config/sops/age/keys.txt).`,
+	Args: cobra.ExactArgs(1),
+	RunE: runEncrypt,
+}
+
+// decryptCmd represents the decrypt command
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt FILE",
+	Short: "Decrypt an encrypted configuration file",
+	Long: `Decrypt a SOPS encrypted configuration file with the local age identity
+(MIKO_AGE_KEY, MIKO_AGE_KEY_FILE or ~/.config/sops/age/keys.txt).
+
+The decrypted file is printed to standard output unless --in-place is used.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runDecrypt,
+}
+
+// editCmd represents the edit command
+var editCmd = &cobra.Command{
+	Use:   "edit FILE",
+	Short: "Edit an encrypted configuration file",
+	Long: `Decrypt a configuration file into a temporary file, open it with $EDITOR
+(vi by default) and encrypt it again for the same recipients when the editor exits.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runEdit,
+}
+
+type EncryptOptions struct {
+	Recipients     []string
+	EncryptedRegex string
+	InPlace        bool
+}
+
+type DecryptOptions struct {
+	InPlace bool
+}
+
+var encryptOptions EncryptOptions
+var decryptOptions DecryptOptions
+
+func init() {
+	encryptCmd.Flags().StringSliceVar(&encryptOptions.Recipients, "age", []string{}, "age recipients to encrypt for (comma separated or repeated)")
+	encryptCmd.Flags().StringVar(&encryptOptions.EncryptedRegex, "encrypted-regex", mikomanifest.DefaultEncryptedRegex, "Only encrypt the values of keys matching this regex")
+	encryptCmd.Flags().BoolVarP(&encryptOptions.InPlace, "in-place", "i", false, "Write the encrypted file over the original instead of printing it")
+
+	decryptCmd.Flags().BoolVarP(&decryptOptions.InPlace, "in-place", "i", false, "Write the decrypted file over the original instead of printing it")
+}
+
+func runEncrypt(cmd *cobra.Command, args []string) error {
+	path := args[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	recipients := encryptOptions.Recipients
+	if len(recipients) == 0 {
+		recipients, err = mikomanifest.DefaultAgeRecipients()
+		if err != nil {
+			return fmt.Errorf("no --age recipients given and no local key available: %v", err)
+		}
+	}
+
+	encrypted, err := mikomanifest.EncryptConfig(data, mikomanifest.EncryptOptions{
+		Recipients:     recipients,
+		EncryptedRegex: encryptOptions.EncryptedRegex,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %v", path, err)
+	}
+
+	return writeSecretsResult(path, encrypted, encryptOptions.InPlace, "Encrypted")
+}
+
+func runDecrypt(cmd *cobra.Command, args []string) error {
+	path := args[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	decrypted, err := mikomanifest.DecryptConfig(data)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %v", path, err)
+	}
+
+	return writeSecretsResult(path, decrypted, decryptOptions.InPlace, "Decrypted")
+}
+
+func runEdit(cmd *cobra.Command, args []string) error {
+	path := args[0]
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	options, err := mikomanifest.EncryptedConfigOptions(data)
+	if err != nil {
+		return fmt.Errorf("cannot edit %s: %v", path, err)
+	}
+
+	decrypted, err := mikomanifest.DecryptConfig(data)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt %s: %v", path, err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "miko-manifest-edit-")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tmpFile := filepath.Join(tmpDir, filepath.Base(path))
+	if err := os.WriteFile(tmpFile, decrypted, 0600); err != nil {
+		return fmt.Errorf("failed to write temporary file: %v", err)
+	}
+
+	if err := runEditor(tmpFile); err != nil {
+		return err
+	}
+
+	edited, err := os.ReadFile(tmpFile)
+	if err != nil {
+		return fmt.Errorf("failed to read edited file: %v", err)
+	}
+
+	outputOpts := output.NewOutputOptions(false)
+	if bytes.Equal(edited, decrypted) {
+		outputOpts.PrintResult(fmt.Sprintf("No changes made to %s", path))
+		return nil
+	}
+
+	var check yaml.Node
+	if err := yaml.Unmarshal(edited, &check); err != nil {
+		return fmt.Errorf("edited file is not valid YAML, %s was left unchanged: %v", path, err)
+	}
+
+	encrypted, err := mikomanifest.EncryptConfig(edited, options)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt %s: %v", path, err)
+	}
+
+	return writeSecretsResult(path, encrypted, true, "Encrypted")
+}
+
+// runEditor opens a file with $EDITOR, which may include arguments
+func runEditor(file string) error {
+	editor := strings.Fields(os.Getenv("EDITOR"))
+	if len(editor) == 0 {
+		editor = []string{"vi"}
+	}
+
+	editorCmd := exec.Command(editor[0], append(editor[1:], file)...)
+	editorCmd.Stdin = os.Stdin
+	editorCmd.Stdout = os.Stdout
+	editorCmd.Stderr = os.Stderr
+	if err := editorCmd.Run(); err != nil {
+		return fmt.Errorf("editor %s failed: %v", editor[0], err)
+	}
+	return nil
+}
+
+// writeSecretsResult prints the result or writes it over the original file,
+// keeping its permissions
+func writeSecretsResult(path string, data []byte, inPlace bool, action string) error {
+	if !inPlace {
+		_, err := os.Stdout.Write(data)
+		return err
+	}
+
+	mode := os.FileMode(0600)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := os.WriteFile(path, data, mode); err != nil {
+		return fmt.Errorf("failed to write %s: %v", path, err)
+	}
+
+	outputOpts := output.NewOutputOptions(false)
+	outputOpts.PrintResult(fmt.Sprintf("%s %s", action, path))
+	return nil
+}
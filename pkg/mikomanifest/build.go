@@ -5,7 +5,6 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
-	"text/template"
 
 	"github.com/jepemo/miko-manifest/pkg/output"
 	"gopkg.in/yaml.v3"
@@ -13,31 +12,110 @@ import (
 
 // Config represents the configuration structure
 type Config struct {
-	Environment string     `yaml:"-"` // Not serialized, set programmatically
-	ConfigDir   string     `yaml:"-"` // Not serialized, set programmatically
-	Resources   []string   `yaml:"resources,omitempty"`
-	Schemas     []string   `yaml:"schemas,omitempty"`
-	Variables   []Variable `yaml:"variables"`
-	Include     []Include  `yaml:"include"`
+	Environment     string                `yaml:"-"` // Not serialized, set programmatically
+	ConfigDir       string                `yaml:"-"` // Not serialized, set programmatically
+	Resources       []string              `yaml:"resources,omitempty"`
+	Schemas         []string              `yaml:"schemas,omitempty"`
+	Merge           MergeOptions          `yaml:"merge,omitempty"`
+	ResourceOptions ResourceOptions       `yaml:"resourceOptions,omitempty"`
+	Declare         []VariableDeclaration `yaml:"declare,omitempty"`
+	Strict          *bool                 `yaml:"strict,omitempty"`   // Fail on undefined template variables, like build --strict
+	Partials        []string              `yaml:"partials,omitempty"` // Helper files with {{define}} blocks, relative to the templates directory
+	Variables       []Variable            `yaml:"variables"`
+	Include         []Include             `yaml:"include"`
+
+	// SensitivePatterns lists variable name patterns ("*_password") whose
+	// values are masked in output, in addition to DefaultSensitivePatterns
+	SensitivePatterns []string `yaml:"sensitivePatterns,omitempty"`
+
+	// Exclude removes includes and schemas inherited from the resources
+	Exclude Exclusions `yaml:"exclude,omitempty"`
+
+	// Removed lists what each layer removed from its resources, set while merging
+	Removed []Removal `yaml:"-"`
+
+	layer string // Path of the config file, set while loading
+
+	// Variable values before their references were resolved, set by
+	// ResolveConfigVariables
+	declared map[string]interface{}
 }
 
-// Variable represents a configuration variable
+// MergeOptions controls how the variables of a config are merged over the
+// layers loaded before it
+type MergeOptions struct {
+	Lists string `yaml:"lists,omitempty"` // "replace" (default) or "append"
+}
+
+// Variable represents a configuration variable.
+// Value holds any YAML value: a scalar, a list or a nested map.
 type Variable struct {
-	Name  string `yaml:"name"`
-	Value string `yaml:"value"`
+	Name      string       `yaml:"name"`
+	Value     interface{}  `yaml:"value"`
+	ValueFrom *ValueSource `yaml:"valueFrom,omitempty"`
+	Sensitive bool         `yaml:"sensitive,omitempty"`
+	Delete    bool         `yaml:"$delete,omitempty"` // Removes the variable inherited from the resources
+
+	// Origins lists where the variable was declared, followed by every layer
+	// (and command line override) that changed it
+	Origins []VariableOrigin `yaml:"-"`
+
+	line int // Line of the declaration, set while decoding
+}
+
+// ValueSource reads a variable value from outside the config file.
+// Exactly one of Env, File or FileBase64 must be set.
+type ValueSource struct {
+	Env        string  `yaml:"env,omitempty"`        // Environment variable name
+	Default    *string `yaml:"default,omitempty"`    // Used when Env is not set
+	File       string  `yaml:"file,omitempty"`       // File path, relative to the config file
+	FileBase64 string  `yaml:"fileBase64,omitempty"` // File path whose content is base64 encoded into the value
+
+	layer string // Config file declaring the source, set while loading
+}
+
+// VariableOrigin records one declaration of a variable
+type VariableOrigin struct {
+	File  string      // Config file path, or "--var" for command line overrides
+	Line  int         // Line of the declaration in File (0 for command line overrides)
+	Value interface{} // Value contributed by this declaration
 }
 
 // Include represents a file to include in the build
 type Include struct {
-	File   string     `yaml:"file"`
-	Repeat string     `yaml:"repeat,omitempty"`
-	List   []ListItem `yaml:"list,omitempty"`
+	ID      string     `yaml:"id,omitempty"`      // Identity used to merge the include across layers, instead of its file
+	Patch   string     `yaml:"$patch,omitempty"`  // "replace" makes an overlay replace the include with the same id instead of extending it
+	File    string     `yaml:"file"`              // Template path, or a glob pattern ("monitoring/*.yaml", "base/**")
+	Exclude []string   `yaml:"exclude,omitempty"` // Patterns removed from the files a glob matches
+	Repeat  string     `yaml:"repeat,omitempty"`
+	List    []ListItem `yaml:"list,omitempty"`
+	// Repeat items read from a CSV, JSON or YAML file; list items are merged over them
+	ListFrom *ListSource `yaml:"listFrom,omitempty"`
+	Matrix   *Matrix     `yaml:"matrix,omitempty"` // Axes whose combinations are the items of repeat: matrix
+	Render   *bool       `yaml:"render,omitempty"` // false copies the file verbatim, without templating
+	Delims   []string    `yaml:"delims,omitempty"` // Alternate template delimiters, e.g. ["[[", "]]"]
+	Output   string      `yaml:"output,omitempty"` // Output path template, e.g. "{{.namespace}}/svc-{{.key}}.yaml"
+	When     string      `yaml:"when,omitempty"`   // Condition template, the include is skipped unless it renders true
+
+	// ChildRepeat set to "same-file" renders each multiple-files item once
+	// per child, as sections of the item file
+	ChildRepeat string `yaml:"childRepeat,omitempty"`
+
+	// Variables only this include sees, for includes without repeat. They
+	// override the global variables; --var overrides still win.
+	Variables []Variable `yaml:"variables,omitempty"`
 }
 
 // ListItem represents an item in a repeat list
 type ListItem struct {
 	Key    string     `yaml:"key"`
+	Patch  string     `yaml:"$patch,omitempty"` // "delete" removes the inherited item, "replace" replaces its values
 	Values []Variable `yaml:"values"`
+	When   string     `yaml:"when,omitempty"` // Condition template evaluated with the item values
+
+	// Children are nested items, available to the template as .children and
+	// rendered one section each with childRepeat: same-file
+	Children []ListItem `yaml:"children,omitempty"`
 }
 
 // BuildOptions contains options for building
@@ -46,13 +124,16 @@ type BuildOptions struct {
 	OutputDir    string
 	ConfigDir    string
 	TemplatesDir string
-	Variables    map[string]string
+	Variables    map[string]interface{}
+	Strict       bool // Fail on undefined template variables instead of rendering "<no value>"
 	OutputOpts   *output.OutputOptions
 }
 
 // MikoManifest is the main library interface
 type MikoManifest struct {
-	options BuildOptions
+	options  BuildOptions
+	partials []partial // Helper files loaded into every template
+	include  *Include  // Include being processed by Build, nil when processors are called directly
 }
 
 // New creates a new MikoManifest instance
@@ -102,6 +183,41 @@ func (m *MikoManifest) loadConfigInternal(env string, showTree bool) (*Config, e
 
 // LoadConfigWithResources loads configuration with resource inclusion and circular dependency detection
 func (m *MikoManifest) LoadConfigWithResources(configPath string, loadChain []string, depth int, showTree bool, outputOpts *output.OutputOptions) (*Config, error) {
+	layers, err := m.loadLayers(configPath, loadChain, depth, showTree, outputOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	// Merge the files in load order, so the exclude, $delete and merge
+	// settings of each file apply to every file loaded before it, however
+	// deep in the resources either of them is
+	config := &Config{
+		Variables: []Variable{},
+		Include:   []Include{},
+	}
+	for _, layer := range layers {
+		config = m.mergeConfigs(config, layer)
+	}
+
+	// Declarations and patterns from every layer are known once the top-level
+	// config is merged
+	if depth == 0 {
+		if err := resolveValueSources(config); err != nil {
+			return nil, err
+		}
+		if err := validateMergedIncludes(config); err != nil {
+			return nil, fmt.Errorf("invalid include settings in %s: %w", configPath, err)
+		}
+		config.applyDeclarationDefaults()
+		config.markSensitiveVariables()
+	}
+
+	return config, nil
+}
+
+// loadLayers loads a config file and, before it, the files of its resources
+// in load order
+func (m *MikoManifest) loadLayers(configPath string, loadChain []string, depth int, showTree bool, outputOpts *output.OutputOptions) ([]*Config, error) {
 	// Check for maximum recursion depth
 	const maxDepth = 5
 	if depth > maxDepth {
@@ -131,61 +247,151 @@ func (m *MikoManifest) LoadConfigWithResources(configPath string, loadChain []st
 		return nil, fmt.Errorf("failed to read config file %s: %w", configPath, err)
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
 		return nil, fmt.Errorf("failed to parse YAML in %s: %w", configPath, err)
 	}
 
-	// Process resources if they exist
-	if len(config.Resources) > 0 {
-		if showTree && outputOpts != nil {
-			outputOpts.PrintInfo(fmt.Sprintf("Processing %d resource(s):", len(config.Resources)))
+	// Decrypt SOPS encrypted files in place so line numbers are kept
+	_, sopsIndex := sopsMetadataNode(&root)
+	encrypted := sopsIndex >= 0
+	if encrypted {
+		identities, err := LoadAgeIdentities()
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", configPath, &UnavailableInputError{Err: err})
+		}
+		if _, err := decryptConfigNode(&root, identities); err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", configPath, &UnavailableInputError{Err: err})
 		}
+	}
+
+	var config Config
+	if root.Kind != 0 {
+		if err := root.Decode(&config); err != nil {
+			return nil, fmt.Errorf("failed to parse YAML in %s: %w", configPath, err)
+		}
+	}
+
+	config.layer = configPath
+
+	// Values kept in encrypted files are secrets
+	if encrypted {
+		for i := range config.Variables {
+			config.Variables[i].Sensitive = true
+		}
+	}
+
+	if err := validateMergeDirectives(&config); err != nil {
+		return nil, fmt.Errorf("invalid merge settings in %s: %w", configPath, err)
+	}
+
+	if err := validateSensitivePatterns(&config); err != nil {
+		return nil, fmt.Errorf("invalid sensitive patterns in %s: %w", configPath, err)
+	}
+
+	if err := validateDeclarations(&config); err != nil {
+		return nil, fmt.Errorf("invalid variable declarations in %s: %w", configPath, err)
+	}
+
+	if err := validateIncludes(&config); err != nil {
+		return nil, fmt.Errorf("invalid include settings in %s: %w", configPath, err)
+	}
+
+	if err := validateExclusions(&config); err != nil {
+		return nil, fmt.Errorf("invalid exclude settings in %s: %w", configPath, err)
+	}
+	for i := range config.Declare {
+		config.Declare[i].Origin.File = configPath
+	}
+
+	// Values from the environment and files are read once every layer is
+	// merged, so a source that a later layer overrides is never read
+	if err := bindValueSources(&config, configPath); err != nil {
+		return nil, fmt.Errorf("invalid variable sources in %s: %w", configPath, err)
+	}
+
+	// Read repeat items from data files
+	if err := resolveListSources(&config, configPath); err != nil {
+		return nil, fmt.Errorf("failed to resolve list sources in %s: %w", configPath, err)
+	}
 
-		baseConfig := &Config{
-			Variables: []Variable{},
-			Include:   []Include{},
+	// Record where each variable comes from
+	for i, v := range config.Variables {
+		value := v.Value
+		if v.ValueFrom != nil {
+			// Replaced by the value read from the source if this declaration wins
+			value = fmt.Sprintf("(from %s)", v.ValueFrom)
 		}
+		config.Variables[i].Origins = []VariableOrigin{{File: configPath, Line: v.line, Value: value}}
+	}
 
-		// Load and merge all resources
-		for _, resource := range config.Resources {
+	// Load the resources first, each file once even if several resources
+	// expand to it
+	var layers []*Config
+	if len(config.Resources) > 0 && showTree && outputOpts != nil {
+		outputOpts.PrintInfo(fmt.Sprintf("Processing %d resource(s):", len(config.Resources)))
+	}
+	loaded := make(map[string]bool)
+	for _, resource := range config.Resources {
+		files, err := expandResource(configPath, resource, config.ResourceOptions.Recursive)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load resources of %s: %w", configPath, err)
+		}
+
+		if showTree && outputOpts != nil {
 			resourcePath := m.resolveResourcePath(configPath, resource)
+			switch {
+			case IsGlobPattern(resource):
+				outputOpts.PrintInfo(fmt.Sprintf("Resource: %s (pattern, %d file(s))", resource, len(files)))
+			case isDirectory(resourcePath) && config.ResourceOptions.Recursive:
+				outputOpts.PrintInfo(fmt.Sprintf("Resource: %s (directory, recursive)", resource))
+			case isDirectory(resourcePath):
+				outputOpts.PrintInfo(fmt.Sprintf("Resource: %s (directory)", resource))
+			default:
+				outputOpts.PrintInfo(fmt.Sprintf("Resource: %s", resource))
+			}
+		}
 
-			if showTree && outputOpts != nil {
-				if isDirectory(resourcePath) {
-					outputOpts.PrintInfo(fmt.Sprintf("Resource: %s (directory)", resource))
-				} else {
-					outputOpts.PrintInfo(fmt.Sprintf("Resource: %s", resource))
-				}
+		for _, file := range files {
+			if loaded[file] {
+				continue
 			}
+			loaded[file] = true
 
-			if isDirectory(resourcePath) {
-				// Load all YAML files from directory in alphabetical order
-				if err := m.loadConfigFromDirectory(resourcePath, baseConfig, currentChain, depth+1, showTree, outputOpts); err != nil {
-					return nil, fmt.Errorf("failed to load from directory %s: %w", resourcePath, err)
-				}
-			} else {
-				// Load single file
-				resourceConfig, err := m.LoadConfigWithResources(resourcePath, currentChain, depth+1, showTree, outputOpts)
-				if err != nil {
-					return nil, fmt.Errorf("failed to load resource %s: %w", resourcePath, err)
-				}
-				*baseConfig = *m.mergeConfigs(baseConfig, resourceConfig)
+			resourceLayers, err := m.loadLayers(file, currentChain, depth+1, showTree, outputOpts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load resource %s: %w", file, err)
 			}
+			layers = append(layers, resourceLayers...)
 		}
-
-		// Merge current config with the base config (current config has higher priority)
-		config = *m.mergeConfigs(baseConfig, &config)
 	}
 
-	return &config, nil
+	// The current config has the highest priority
+	return append(layers, &config), nil
 }
 
-// ValidateTemplateFiles checks that all template files exist
-func (m *MikoManifest) ValidateTemplateFiles(includes []Include) error {
+// ValidateTemplateFiles checks that all template files exist, that every
+// glob pattern matches at least one of them and that no include names a
+// helper file or one of the given partials
+func (m *MikoManifest) ValidateTemplateFiles(includes []Include, partials ...string) error {
 	templatesPath := m.options.TemplatesDir
 
+	includes, err := m.ExpandIncludes(includes, partials...)
+	if err != nil {
+		return err
+	}
+
+	isPartial := make(map[string]bool, len(partials))
+	for _, p := range partials {
+		isPartial[p] = true
+	}
 	for _, include := range includes {
+		if IsHelperFile(include.File) {
+			return fmt.Errorf("template file %s is a helper file and cannot be included, use it from other templates with include", include.File)
+		}
+		if isPartial[outputBaseName(include.File)] {
+			return fmt.Errorf("template file %s is a partial and cannot be included, use it from other templates with include", include.File)
+		}
 		templatePath := filepath.Join(templatesPath, include.File)
 		if _, err := os.Stat(templatePath); os.IsNotExist(err) {
 			return fmt.Errorf("template file %s not found", templatePath)
@@ -196,8 +402,8 @@ func (m *MikoManifest) ValidateTemplateFiles(includes []Include) error {
 }
 
 // MergeVariables merges global and local variables
-func (m *MikoManifest) MergeVariables(globalVars []Variable, localVars []Variable, cmdVars map[string]string) map[string]string {
-	variables := make(map[string]string)
+func (m *MikoManifest) MergeVariables(globalVars []Variable, localVars []Variable, cmdVars map[string]interface{}) map[string]interface{} {
+	variables := make(map[string]interface{})
 
 	// Add global variables
 	for _, v := range globalVars {
@@ -209,21 +415,32 @@ func (m *MikoManifest) MergeVariables(globalVars []Variable, localVars []Variabl
 		variables[v.Name] = v.Value
 	}
 
-	// Add command line variables (highest priority)
+	// Add command line variables (highest priority), kept literally
 	for k, v := range cmdVars {
-		variables[k] = v
+		variables[k] = escapeReferences(v)
 	}
 
 	return variables
 }
 
-// RenderTemplate renders a template with variables
-func (m *MikoManifest) RenderTemplate(templateContent string, variables map[string]string, templateName string) (string, error) {
-	tmpl, err := template.New(templateName).Parse(templateContent)
+// RenderTemplate renders a template with variables, the template function
+// library and the loaded partials
+func (m *MikoManifest) RenderTemplate(templateContent string, variables map[string]interface{}, templateName string) (string, error) {
+	tmpl, err := m.newTemplate(templateName)
 	if err != nil {
+		return "", err
+	}
+	if m.include != nil && len(m.include.Delims) == 2 {
+		tmpl.Delims(m.include.Delims[0], m.include.Delims[1])
+	}
+	if _, err := tmpl.Parse(templateContent); err != nil {
 		return "", fmt.Errorf("failed to parse template %s: %w", templateName, err)
 	}
 
+	if m.options.Strict {
+		return renderStrict(tmpl, variables, templateName)
+	}
+
 	var result strings.Builder
 	if err := tmpl.Execute(&result, variables); err != nil {
 		return "", fmt.Errorf("failed to execute template %s: %w", templateName, err)
@@ -233,13 +450,19 @@ func (m *MikoManifest) RenderTemplate(templateContent string, variables map[stri
 }
 
 // ProcessSimpleFile processes a simple file
-func (m *MikoManifest) ProcessSimpleFile(templatePath, outputDir string, variables map[string]string, outputOpts *output.OutputOptions) error {
+func (m *MikoManifest) ProcessSimpleFile(templatePath, outputDir string, variables map[string]interface{}, outputOpts *output.OutputOptions) error {
 	content, err := os.ReadFile(templatePath)
 	if err != nil {
 		return fmt.Errorf("failed to read template %s: %w", templatePath, err)
 	}
 
-	rendered, err := m.RenderTemplate(string(content), variables, filepath.Base(templatePath))
+	name := m.templateName(templatePath)
+	variables, err = ResolveVariableReferences(variables)
+	if err != nil {
+		return fmt.Errorf("failed to resolve variables for %s: %w", name, err)
+	}
+
+	rendered, err := m.RenderTemplate(string(content), variables, name)
 	if err != nil {
 		return err
 	}
@@ -249,42 +472,103 @@ func (m *MikoManifest) ProcessSimpleFile(templatePath, outputDir string, variabl
 		rendered += "\n"
 	}
 
-	outputFile := filepath.Join(outputDir, filepath.Base(templatePath))
-	if err := os.WriteFile(outputFile, []byte(rendered), 0644); err != nil {
-		return fmt.Errorf("failed to write output file %s: %w", outputFile, err)
+	outputFile, err := m.include.outputName(name, nil, variables)
+	if err != nil {
+		return err
+	}
+	if err := writeOutputFile(outputDir, outputFile, []byte(rendered)); err != nil {
+		return err
 	}
 
-	outputOpts.PrintProcessed(filepath.Base(templatePath), filepath.Base(outputFile), "")
+	outputOpts.PrintProcessed(name, outputFile, "")
+	return nil
+}
+
+// ProcessRawFile copies a file to the output directory without templating.
+// Variables are only used by the output path template.
+func (m *MikoManifest) ProcessRawFile(templatePath, outputDir string, variables map[string]interface{}, outputOpts *output.OutputOptions) error {
+	content, err := os.ReadFile(templatePath)
+	if err != nil {
+		return fmt.Errorf("failed to read template %s: %w", templatePath, err)
+	}
+
+	name := m.templateName(templatePath)
+	variables, err = ResolveVariableReferences(variables)
+	if err != nil {
+		return fmt.Errorf("failed to resolve variables for %s: %w", name, err)
+	}
+
+	outputFile, err := m.include.outputName(name, nil, variables)
+	if err != nil {
+		return err
+	}
+	if err := writeOutputFile(outputDir, outputFile, content); err != nil {
+		return err
+	}
+
+	outputOpts.PrintProcessed(name, outputFile, "raw")
 	return nil
 }
 
 // ProcessSameFileRepeat processes a file with same-file repeat pattern
-func (m *MikoManifest) ProcessSameFileRepeat(templatePath, outputDir string, globalVars map[string]string, listItems []ListItem, outputOpts *output.OutputOptions) error {
+func (m *MikoManifest) ProcessSameFileRepeat(templatePath, outputDir string, globalVars map[string]interface{}, listItems []ListItem, outputOpts *output.OutputOptions) error {
 	content, err := os.ReadFile(templatePath)
 	if err != nil {
 		return fmt.Errorf("failed to read template %s: %w", templatePath, err)
 	}
 
+	name := m.templateName(templatePath)
+	finalContent, err := m.renderSections(string(content), name, globalVars, listItems)
+	if err != nil {
+		return err
+	}
+
+	variables, err := ResolveVariableReferences(globalVars)
+	if err != nil {
+		return fmt.Errorf("failed to resolve variables for %s: %w", name, err)
+	}
+	outputFile, err := m.include.outputName(name, nil, variables)
+	if err != nil {
+		return err
+	}
+	if err := writeOutputFile(outputDir, outputFile, []byte(finalContent)); err != nil {
+		return err
+	}
+
+	outputOpts.PrintProcessed(name, outputFile, fmt.Sprintf("%d sections", len(listItems)))
+	return nil
+}
+
+// renderSections renders a template once per item and joins the parts into
+// the content of a single file
+func (m *MikoManifest) renderSections(content, name string, globalVars map[string]interface{}, listItems []ListItem) (string, error) {
 	var renderedParts []string
+	var missing []*MissingKeyError
 
 	for _, item := range listItems {
 		// Merge global variables with item-specific values
-		variables := make(map[string]string)
-		for k, v := range globalVars {
-			variables[k] = v
-		}
-		for _, v := range item.Values {
-			variables[v.Name] = v.Value
+		itemName := fmt.Sprintf("%s[%s]", name, item.Key)
+		variables, err := itemVariables(globalVars, item)
+		if err != nil {
+			return "", fmt.Errorf("failed to resolve variables for %s: %w", itemName, err)
 		}
 
-		rendered, err := m.RenderTemplate(string(content), variables, fmt.Sprintf("%s[%s]", filepath.Base(templatePath), item.Key))
+		rendered, err := m.RenderTemplate(content, variables, itemName)
 		if err != nil {
-			return err
+			// Keep rendering the other items to report every missing key
+			if addStrictErrors(&missing, err) {
+				continue
+			}
+			return "", err
 		}
 
 		renderedParts = append(renderedParts, rendered)
 	}
 
+	if len(missing) > 0 {
+		return "", &StrictModeError{Templates: missing}
+	}
+
 	// Join all parts with separator
 	// Since each rendered part starts with "---", we only need a newline separator
 	finalContent := strings.Join(renderedParts, "\n")
@@ -293,39 +577,45 @@ func (m *MikoManifest) ProcessSameFileRepeat(templatePath, outputDir string, glo
 	if !strings.HasSuffix(finalContent, "\n") {
 		finalContent += "\n"
 	}
-
-	outputFile := filepath.Join(outputDir, filepath.Base(templatePath))
-	if err := os.WriteFile(outputFile, []byte(finalContent), 0644); err != nil {
-		return fmt.Errorf("failed to write output file %s: %w", outputFile, err)
-	}
-
-	outputOpts.PrintProcessed(filepath.Base(templatePath), filepath.Base(outputFile), fmt.Sprintf("%d sections", len(listItems)))
-	return nil
+	return finalContent, nil
 }
 
-// ProcessMultipleFilesRepeat processes a file with multiple-files repeat pattern
-func (m *MikoManifest) ProcessMultipleFilesRepeat(templatePath, outputDir string, globalVars map[string]string, listItems []ListItem, outputOpts *output.OutputOptions) error {
+// ProcessMultipleFilesRepeat processes a file with multiple-files repeat pattern.
+// With childRepeat: same-file each file holds one section per child of its item.
+func (m *MikoManifest) ProcessMultipleFilesRepeat(templatePath, outputDir string, globalVars map[string]interface{}, listItems []ListItem, outputOpts *output.OutputOptions) error {
 	content, err := os.ReadFile(templatePath)
 	if err != nil {
 		return fmt.Errorf("failed to read template %s: %w", templatePath, err)
 	}
 
-	filename := filepath.Base(templatePath)
-	ext := filepath.Ext(filename)
-	stem := strings.TrimSuffix(filename, ext)
+	filename := m.templateName(templatePath)
+	var missing []*MissingKeyError
 
 	for _, item := range listItems {
 		// Merge global variables with item-specific values
-		variables := make(map[string]string)
-		for k, v := range globalVars {
-			variables[k] = v
-		}
-		for _, v := range item.Values {
-			variables[v.Name] = v.Value
+		itemName := fmt.Sprintf("%s[%s]", filename, item.Key)
+		variables, err := itemVariables(globalVars, item)
+		if err != nil {
+			return fmt.Errorf("failed to resolve variables for %s: %w", itemName, err)
 		}
 
-		rendered, err := m.RenderTemplate(string(content), variables, fmt.Sprintf("%s[%s]", filename, item.Key))
+		var rendered string
+		details := "multi-file"
+		if m.include != nil && m.include.ChildRepeat == "same-file" {
+			if len(item.Children) == 0 {
+				return fmt.Errorf("%s: childRepeat: same-file requires children", itemName)
+			}
+			// Children see the item values, but not the other children
+			rendered, err = m.renderSections(string(content), itemName, parentValues(globalVars, item), childSections(item.Children))
+			details = fmt.Sprintf("multi-file, %d sections", len(item.Children))
+		} else {
+			rendered, err = m.RenderTemplate(string(content), variables, itemName)
+		}
 		if err != nil {
+			// Keep rendering the other items to report every missing key
+			if addStrictErrors(&missing, err) {
+				continue
+			}
 			return err
 		}
 
@@ -334,16 +624,20 @@ func (m *MikoManifest) ProcessMultipleFilesRepeat(templatePath, outputDir string
 			rendered += "\n"
 		}
 
-		outputFilename := fmt.Sprintf("%s-%s%s", stem, item.Key, ext)
-		outputFile := filepath.Join(outputDir, outputFilename)
-
-		if err := os.WriteFile(outputFile, []byte(rendered), 0644); err != nil {
-			return fmt.Errorf("failed to write output file %s: %w", outputFile, err)
+		outputFilename, err := m.include.outputName(filename, &item, variables)
+		if err != nil {
+			return err
+		}
+		if err := writeOutputFile(outputDir, outputFilename, []byte(rendered)); err != nil {
+			return err
 		}
 
-		outputOpts.PrintProcessed(filename, outputFilename, "multi-file")
+		outputOpts.PrintProcessed(filename, outputFilename, details)
 	}
 
+	if len(missing) > 0 {
+		return &StrictModeError{Templates: missing}
+	}
 	return nil
 }
 
@@ -376,8 +670,43 @@ func (m *MikoManifest) Build() error {
 		return fmt.Errorf("no 'include' section found in configuration")
 	}
 
-	// Check that all template files exist
-	if err := m.ValidateTemplateFiles(config.Include); err != nil {
+	if config.Strict != nil && *config.Strict {
+		m.options.Strict = true
+	}
+
+	// Values of sensitive overrides must not show up in output either
+	var sensitiveOverrides []interface{}
+	for _, name := range sortedKeys(m.options.Variables) {
+		value := m.options.Variables[name]
+		display := FormatVariableValue(value)
+		if config.IsSensitive(name) {
+			sensitiveOverrides = append(sensitiveOverrides, value)
+			display = MaskedValue
+		}
+		outputOpts.PrintInfo(fmt.Sprintf("Override variable: %s=%s", name, display))
+	}
+
+	// Check declared variables once command line overrides are applied
+	if err := CheckDeclarations(config, m.options.Variables); err != nil {
+		return config.RedactError(err, sensitiveOverrides...)
+	}
+
+	// Load the helper files shared by every template, which are not built
+	partials, err := m.LoadPartials(config.Partials)
+	if err != nil {
+		return err
+	}
+
+	// Expand glob patterns and check that all template files exist
+	includes, err := m.ExpandIncludes(config.Include, partials...)
+	if err != nil {
+		return err
+	}
+	includes, err = expandMatrices(includes)
+	if err != nil {
+		return err
+	}
+	if err := m.ValidateTemplateFiles(includes, partials...); err != nil {
 		return err
 	}
 
@@ -390,29 +719,64 @@ func (m *MikoManifest) Build() error {
 	// Get global variables and merge with command line overrides
 	globalVariables := m.MergeVariables(config.Variables, nil, m.options.Variables)
 
-	// Process each file in include
-	for _, include := range config.Include {
+	// Leave out the includes and repeat items whose when condition is false.
+	// Conditions take the variables as declared, resolving them only once.
+	if _, err := ResolveVariableReferences(globalVariables); err != nil {
+		return config.RedactError(fmt.Errorf("failed to resolve variables: %w", err), sensitiveOverrides...)
+	}
+	includes, skipped, err := ApplyConditions(includes, globalVariables)
+	if err != nil {
+		return config.RedactError(err, sensitiveOverrides...)
+	}
+	for _, s := range skipped {
+		outputOpts.PrintInfo(fmt.Sprintf("Skipped %s", s))
+	}
+
+	// Fail before writing anything if two includes produce the same file
+	if err := m.checkOutputCollisions(includes, config.Variables); err != nil {
+		return config.RedactError(err, sensitiveOverrides...)
+	}
+
+	// Process each file in include. In strict mode templates with missing keys
+	// are collected so every one of them is reported at the end.
+	var missing []*MissingKeyError
+	for _, include := range includes {
 		templatePath := filepath.Join(m.options.TemplatesDir, include.File)
 
-		switch include.Repeat {
-		case "":
+		// Variables of the include itself sit between the global variables
+		// and the command line overrides
+		localVariables := globalVariables
+		if len(include.Variables) > 0 {
+			localVariables = m.MergeVariables(config.Variables, include.Variables, m.options.Variables)
+		}
+
+		var err error
+		m.include = &include
+		switch {
+		case !include.Rendered():
+			// Raw file, copied without templating
+			err = m.ProcessRawFile(templatePath, m.options.OutputDir, localVariables, outputOpts)
+		case include.Repeat == "":
 			// Simple file include
-			if err := m.ProcessSimpleFile(templatePath, m.options.OutputDir, globalVariables, outputOpts); err != nil {
-				return err
-			}
-		case "same-file":
+			err = m.ProcessSimpleFile(templatePath, m.options.OutputDir, localVariables, outputOpts)
+		case include.Repeat == "same-file":
 			// Same-file repeat
-			if err := m.ProcessSameFileRepeat(templatePath, m.options.OutputDir, globalVariables, include.List, outputOpts); err != nil {
-				return err
-			}
-		case "multiple-files":
+			err = m.ProcessSameFileRepeat(templatePath, m.options.OutputDir, globalVariables, include.List, outputOpts)
+		case include.Repeat == "multiple-files":
 			// Multiple-files repeat
-			if err := m.ProcessMultipleFilesRepeat(templatePath, m.options.OutputDir, globalVariables, include.List, outputOpts); err != nil {
-				return err
-			}
+			err = m.ProcessMultipleFilesRepeat(templatePath, m.options.OutputDir, globalVariables, include.List, outputOpts)
 		default:
 			return fmt.Errorf("unknown repeat type: %s", include.Repeat)
 		}
+		if err != nil && !addStrictErrors(&missing, err) {
+			return config.RedactError(err, sensitiveOverrides...)
+		}
+	}
+
+	m.include = nil
+
+	if len(missing) > 0 {
+		return &StrictModeError{Templates: missing}
 	}
 
 	// Save environment info for auto-detection during lint
@@ -451,12 +815,17 @@ func (m *MikoManifest) validateDirectories() error {
 
 // resolveResourcePath resolves a resource path relative to the config file location
 func (m *MikoManifest) resolveResourcePath(configPath, resourcePath string) string {
-	if filepath.IsAbs(resourcePath) {
-		return resourcePath
+	return resolveRelativePath(configPath, resourcePath)
+}
+
+// resolveRelativePath resolves a path relative to the directory of the config file
+func resolveRelativePath(configPath, path string) string {
+	if filepath.IsAbs(path) {
+		return path
 	}
 
 	configDir := filepath.Dir(configPath)
-	return filepath.Join(configDir, resourcePath)
+	return filepath.Join(configDir, path)
 }
 
 // isDirectory checks if the given path is a directory
@@ -465,72 +834,80 @@ func isDirectory(path string) bool {
 	return err == nil && stat.IsDir()
 }
 
-// loadConfigFromDirectory loads all YAML files from a directory and merges them
-func (m *MikoManifest) loadConfigFromDirectory(dirPath string, baseConfig *Config, loadChain []string, depth int, showTree bool, outputOpts *output.OutputOptions) error {
-	entries, err := os.ReadDir(dirPath)
-	if err != nil {
-		return fmt.Errorf("failed to read directory %s: %w", dirPath, err)
-	}
-
-	// Filter and sort YAML files
-	var yamlFiles []string
-	for _, entry := range entries {
-		if entry.IsDir() {
-			continue
-		}
-
-		name := entry.Name()
-		if strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml") {
-			yamlFiles = append(yamlFiles, filepath.Join(dirPath, name))
-		}
-	}
-
-	// Process files in alphabetical order (already sorted by ReadDir)
-	for _, yamlFile := range yamlFiles {
-		resourceConfig, err := m.LoadConfigWithResources(yamlFile, loadChain, depth, showTree, outputOpts)
-		if err != nil {
-			return fmt.Errorf("failed to load file %s: %w", yamlFile, err)
-		}
-		*baseConfig = *m.mergeConfigs(baseConfig, resourceConfig)
-	}
-
-	return nil
-}
-
 // mergeConfigs merges two configurations, with the override config taking precedence
 func (m *MikoManifest) mergeConfigs(base, override *Config) *Config {
 	result := &Config{
 		Variables: make([]Variable, 0),
 		Include:   make([]Include, 0),
 		Schemas:   make([]string, 0),
+		Removed:   append(append([]Removal{}, base.Removed...), override.Removed...),
 	}
 
-	// Create a map for easier variable merging
-	variableMap := make(map[string]string)
+	// Merge variables keeping declaration order: base variables first, overridden
+	// ones stay in place and new ones are appended
+	variableIndex := make(map[string]int)
 
 	// Add base variables
 	for _, v := range base.Variables {
-		variableMap[v.Name] = v.Value
+		if i, exists := variableIndex[v.Name]; exists {
+			result.Variables[i].Value = v.Value
+			result.Variables[i].ValueFrom = v.ValueFrom
+			result.Variables[i].Sensitive = result.Variables[i].Sensitive || v.Sensitive
+			result.Variables[i].Origins = appendOrigins(result.Variables[i].Origins, v.Origins)
+			continue
+		}
+		variableIndex[v.Name] = len(result.Variables)
+		result.Variables = append(result.Variables, v)
 	}
 
-	// Override with variables from override config
+	// Override with variables from override config, deep merging nested maps.
+	// Variables marked with $delete remove the inherited ones.
+	deleted := make(map[string]bool)
 	for _, v := range override.Variables {
-		variableMap[v.Name] = v.Value
-	}
-
-	// Convert back to slice
-	for name, value := range variableMap {
+		if v.Delete {
+			if _, exists := variableIndex[v.Name]; exists && !deleted[v.Name] {
+				deleted[v.Name] = true
+				result.Removed = append(result.Removed, Removal{Kind: "variable", Name: v.Name, Layer: override.layer})
+			}
+			continue
+		}
+		if i, exists := variableIndex[v.Name]; exists {
+			result.Variables[i].Value = mergeValues(result.Variables[i].Value, v.Value, override.Merge)
+			result.Variables[i].ValueFrom = v.ValueFrom
+			// Once a variable is sensitive, overriding layers cannot expose it
+			result.Variables[i].Sensitive = result.Variables[i].Sensitive || v.Sensitive
+			result.Variables[i].Origins = appendOrigins(result.Variables[i].Origins, v.Origins)
+			continue
+		}
+		variableIndex[v.Name] = len(result.Variables)
 		result.Variables = append(result.Variables, Variable{
-			Name:  name,
-			Value: value,
+			Name:      v.Name,
+			Value:     mergeValues(nil, v.Value, override.Merge),
+			ValueFrom: v.ValueFrom,
+			Sensitive: v.Sensitive,
+			Origins:   v.Origins,
 		})
 	}
 
+	if len(deleted) > 0 {
+		kept := result.Variables[:0]
+		for _, v := range result.Variables {
+			if !deleted[v.Name] {
+				kept = append(kept, v)
+			}
+		}
+		result.Variables = kept
+	}
+
 	// Merge schemas (no duplicates)
 	schemaSet := make(map[string]bool)
 
-	// Add base schemas
+	// Add base schemas, except the ones the override excludes
 	for _, schema := range base.Schemas {
+		if override.Exclude.excludesSchema(schema) {
+			result.Removed = append(result.Removed, Removal{Kind: "schema", Name: schema, Layer: override.layer})
+			continue
+		}
 		if !schemaSet[schema] {
 			result.Schemas = append(result.Schemas, schema)
 			schemaSet[schema] = true
@@ -545,34 +922,89 @@ func (m *MikoManifest) mergeConfigs(base, override *Config) *Config {
 		}
 	}
 
-	// Merge includes (no duplicates based on file+key combination)
-	includeMap := make(map[string]Include)
+	// The last layer setting strict mode wins
+	result.Strict = base.Strict
+	if override.Strict != nil {
+		result.Strict = override.Strict
+	}
 
-	// Add base includes
-	for _, inc := range base.Include {
-		key := m.getIncludeKey(inc)
-		includeMap[key] = inc
+	// Merge declarations by name, later layers replace earlier ones in place
+	declarationIndex := make(map[string]int)
+	for _, d := range append(append([]VariableDeclaration{}, base.Declare...), override.Declare...) {
+		if i, exists := declarationIndex[d.Name]; exists {
+			result.Declare[i] = d
+			continue
+		}
+		declarationIndex[d.Name] = len(result.Declare)
+		result.Declare = append(result.Declare, d)
 	}
 
-	// Add override includes (may override base includes)
-	for _, inc := range override.Include {
-		key := m.getIncludeKey(inc)
-		includeMap[key] = inc
+	// Merge partials (no duplicates)
+	partialSet := make(map[string]bool)
+	for _, partial := range append(append([]string{}, base.Partials...), override.Partials...) {
+		if !partialSet[partial] {
+			result.Partials = append(result.Partials, partial)
+			partialSet[partial] = true
+		}
 	}
 
-	// Convert back to slice
-	for _, inc := range includeMap {
+	// Merge sensitive patterns (no duplicates)
+	patternSet := make(map[string]bool)
+	for _, pattern := range append(append([]string{}, base.SensitivePatterns...), override.SensitivePatterns...) {
+		if !patternSet[pattern] {
+			result.SensitivePatterns = append(result.SensitivePatterns, pattern)
+			patternSet[pattern] = true
+		}
+	}
+
+	// Merge includes (no duplicates based on id or file+key combination), keeping
+	// declaration order the same way as variables
+	includeIndex := make(map[string]int)
+
+	// Add base includes, except the ones the override excludes, then override
+	// includes (may override base includes)
+	inherited := make([]Include, 0, len(base.Include))
+	for _, inc := range base.Include {
+		if override.Exclude.excludesInclude(inc) {
+			result.Removed = append(result.Removed, Removal{Kind: "include", Name: inc.Name(), Layer: override.layer})
+			continue
+		}
+		inherited = append(inherited, inc)
+	}
+	for _, inc := range append(inherited, override.Include...) {
+		key := getIncludeKey(inc)
+		if i, exists := includeIndex[key]; exists {
+			if inc.ID != "" {
+				// Includes with an id are extended unless $patch: replace is set
+				result.Include[i] = mergeInclude(result.Include[i], inc, override.Merge)
+			} else {
+				previous := result.Include[i]
+				result.Include[i] = inc
+				result.Include[i].List = mergeListItems(previous.List, inc.List, override.Merge)
+				if inc.ListFrom == nil {
+					result.Include[i].ListFrom = previous.ListFrom
+				}
+			}
+			continue
+		}
+		includeIndex[key] = len(result.Include)
+		inc.List = mergeListItems(nil, inc.List, override.Merge)
 		result.Include = append(result.Include, inc)
 	}
 
 	return result
 }
 
-// getIncludeKey generates a unique key for an include based on file and repeat key
-func (m *MikoManifest) getIncludeKey(inc Include) string {
-	if inc.Repeat != "" && len(inc.List) > 0 {
-		// For repeat includes, create a key based on file and first list key
-		return fmt.Sprintf("%s:%s:%s", inc.File, inc.Repeat, inc.List[0].Key)
+// getIncludeKey generates a unique key for an include: its id, or else its
+// file and repeat type
+func getIncludeKey(inc Include) string {
+	if inc.ID != "" {
+		return "id:" + inc.ID
+	}
+	if inc.Repeat != "" {
+		// Repeat includes are keyed by file and repeat type, their lists are
+		// merged item by item
+		return fmt.Sprintf("%s:%s", inc.File, inc.Repeat)
 	}
 	return inc.File
 }
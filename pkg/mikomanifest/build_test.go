@@ -22,7 +22,7 @@ func TestBuildOptions_Validate(t *testing.T) {
 				OutputDir:    "/tmp/output",
 				ConfigDir:    "/tmp/config",
 				TemplatesDir: "/tmp/templates",
-				Variables:    map[string]string{"key": "value"},
+				Variables:    map[string]interface{}{"key": "value"},
 			},
 			wantErr: false,
 		},
@@ -33,7 +33,7 @@ func TestBuildOptions_Validate(t *testing.T) {
 				OutputDir:    "/tmp/output",
 				ConfigDir:    "/tmp/config",
 				TemplatesDir: "/tmp/templates",
-				Variables:    map[string]string{},
+				Variables:    map[string]interface{}{},
 			},
 			wantErr: true,
 		},
@@ -70,14 +70,14 @@ func TestMergeVariables(t *testing.T) {
 		{Name: "DB_HOST", Value: "localhost"},
 	}
 
-	cmdVars := map[string]string{
+	cmdVars := map[string]interface{}{
 		"DB_HOST": "production.db",
 		"NEW_VAR": "new_value",
 	}
 
 	result := m.MergeVariables(globalVars, localVars, cmdVars)
 
-	expected := map[string]string{
+	expected := map[string]interface{}{
 		"APP_NAME": "myapp",
 		"ENV":      "test",
 		"DB_HOST":  "production.db",
@@ -95,7 +95,7 @@ func TestRenderTemplate(t *testing.T) {
 	templateContent := `name: {{.app_name}}
 replicas: {{.replicas}}`
 
-	variables := map[string]string{
+	variables := map[string]interface{}{
 		"app_name": "test-app",
 		"replicas": "3",
 	}
@@ -129,7 +129,7 @@ replicas: {{.replicas}}`
 	}
 
 	// Test variables
-	variables := map[string]string{
+	variables := map[string]interface{}{
 		"app_name": "test-app",
 		"replicas": "3",
 	}
@@ -304,7 +304,7 @@ spec:
 		OutputDir:    outputDir,
 		ConfigDir:    configDir,
 		TemplatesDir: templatesDir,
-		Variables:    map[string]string{"replicas": "5"}, // Override config value
+		Variables:    map[string]interface{}{"replicas": "5"}, // Override config value
 	}
 
 	m := New(options)
@@ -0,0 +1,220 @@
+package mikomanifest
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildNestedRepeat(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: namespace
+    value: shop
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: name
+            value: api
+        children:
+          - key: http
+            values:
+              - name: port
+                value: 80
+          - key: metrics
+            values:
+              - name: port
+                value: 9090
+  - file: queues.yaml
+    repeat: multiple-files
+    childRepeat: same-file
+    list:
+      - key: acme
+        values:
+          - name: tenant
+            value: acme
+          - name: durable
+            value: true
+        children:
+          - key: orders
+          - key: audit
+            when: "{{ .durable }}"
+          - key: events
+            values:
+              - name: durable
+                value: false
+      - key: globex
+        values:
+          - name: tenant
+            value: globex
+          - name: durable
+            value: false
+        children:
+          - key: audit
+            when: "{{ .durable }}"
+`)
+	h.CreateFile("templates/service.yaml", "name: {{ .name }}\nports:\n{{- range .children }}\n  - name: {{ .key }}\n    port: {{ .port }}\n{{- end }}\n")
+	h.CreateFile("templates/queues.yaml", "---\nqueue: {{ .tenant }}-{{ .key }}\nnamespace: {{ .namespace }}\ndurable: {{ .durable }}\n")
+
+	out := h.CaptureOutput(func() {
+		h.AssertNoError(New(h.GetBuildOptions()).Build())
+	})
+
+	h.AssertFileContains("output/service-api.yaml", "name: api\nports:\n  - name: http\n    port: 80\n  - name: metrics\n    port: 9090\n")
+	h.AssertFileContains("output/queues-acme.yaml", "---\nqueue: acme-orders\nnamespace: shop\ndurable: true\n\n---\nqueue: acme-audit\nnamespace: shop\ndurable: true\n\n---\nqueue: acme-events\nnamespace: shop\ndurable: false\n")
+	h.AssertStringContains(out, "PROCESSED: queues.yaml -> queues-acme.yaml (multi-file, 3 sections)")
+	if h.FileExists("output/queues-globex.yaml") {
+		t.Error("Expected an item whose children are all skipped not to be built")
+	}
+}
+
+func TestNestedRepeatMergesChildrenByKey(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        children:
+          - key: http
+            values:
+              - name: port
+                value: 80
+          - key: debug
+            values:
+              - name: port
+                value: 6060
+`)
+	h.CreateFile("config/test.yaml", `---
+resources:
+  - base.yaml
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        children:
+          - key: http
+            values:
+              - name: port
+                value: 8080
+          - key: debug
+            $patch: delete
+          - key: metrics
+            values:
+              - name: port
+                value: 9090
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "test", false)
+	h.AssertNoError(err)
+
+	children := config.Include[0].List[0].Children
+	if len(children) != 2 || children[0].Key != "http" || children[1].Key != "metrics" {
+		t.Fatalf("Expected children [http metrics], got %v", children)
+	}
+	if children[0].Values[0].Value != 8080 {
+		t.Errorf("Expected the overlay port of http, got %v", children[0].Values[0].Value)
+	}
+}
+
+func TestChildlessItemsInStrictMode(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        children:
+          - key: http
+      - key: batch
+`)
+	h.CreateFile("templates/service.yaml", "ports:\n{{- range .children }}\n  - {{ .key }}{{ range .children }}/{{ .key }}{{ end }}\n{{- end }}\n")
+
+	options := h.GetBuildOptions()
+	options.Strict = true
+	h.AssertNoError(New(options).Build())
+
+	h.AssertFileContains("output/service-api.yaml", "ports:\n  - http\n")
+	h.AssertFileContains("output/service-batch.yaml", "ports:\n")
+}
+
+func TestChildRepeatKeepsLiteralReferences(t *testing.T) {
+	h := NewTestHelper(t)
+	t.Setenv("MIKO_TEST_PASSWORD", "ab${zz}cd")
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: password
+    valueFrom:
+      env: MIKO_TEST_PASSWORD
+include:
+  - file: users.yaml
+    repeat: multiple-files
+    childRepeat: same-file
+    list:
+      - key: acme
+        values:
+          - name: admin
+            value: true
+        children:
+          - key: alice
+            when: "{{ .admin }}"
+          - key: bob
+`)
+	h.CreateFile("templates/users.yaml", "---\nuser: {{ .key }}\npassword: {{ .password }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/users-acme.yaml", "---\nuser: alice\npassword: ab${zz}cd\n\n---\nuser: bob\npassword: ab${zz}cd\n")
+}
+
+func TestNestedRepeatErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		expected string
+	}{
+		{
+			name:     "childRepeat without multiple-files",
+			include:  "    repeat: same-file\n    childRepeat: same-file\n    list: [{key: a, children: [{key: x}]}]\n",
+			expected: "app.yaml: childRepeat: same-file requires repeat: multiple-files",
+		},
+		{
+			name:     "unknown childRepeat",
+			include:  "    repeat: multiple-files\n    childRepeat: multiple-files\n    list: [{key: a, children: [{key: x}]}]\n",
+			expected: "app.yaml: unknown childRepeat \"multiple-files\" (expected same-file)",
+		},
+		{
+			name:     "duplicate child key",
+			include:  "    repeat: multiple-files\n    list: [{key: a, children: [{key: x}, {key: x}]}]\n",
+			expected: "app.yaml[a]: duplicate list key \"x\"",
+		},
+		{
+			name:     "invalid child when",
+			include:  "    repeat: multiple-files\n    list: [{key: a, children: [{key: x, when: \"{{ end }}\"}]}]\n",
+			expected: "app.yaml[a][x]: invalid when condition",
+		},
+		{
+			name:     "item without children",
+			include:  "    repeat: multiple-files\n    childRepeat: same-file\n    list: [{key: a}]\n",
+			expected: "app.yaml[a]: childRepeat: same-file requires children",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "include:\n  - file: app.yaml\n"+tt.include)
+			h.CreateFile("templates/app.yaml", "key: {{ .key }}\n")
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.expected)
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// SkippedInclude records an include, or a repeat item, left out of a build
+// because its when condition is false
+type SkippedInclude struct {
+	File string
+	Key  string // Repeat item key, empty when the whole include is skipped
+	When string
+}
+
+// String describes why the include was skipped
+func (s SkippedInclude) String() string {
+	name := s.File
+	if s.Key != "" {
+		name = fmt.Sprintf("%s[%s]", s.File, s.Key)
+	}
+	return fmt.Sprintf("%s: when %s is false", name, s.When)
+}
+
+// Enabled evaluates the when condition of an include against the merged
+// variables, as declared (see DeclaredValues). An include without a condition
+// is always enabled.
+func (inc Include) Enabled(variables map[string]interface{}) (bool, error) {
+	if inc.When == "" {
+		return true, nil
+	}
+	variables, err := ResolveVariableReferences(variables)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve variables for %s: %w", inc.File, err)
+	}
+	enabled, err := evaluateWhen(inc.When, variables)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate when of %s: %w", inc.File, err)
+	}
+	return enabled, nil
+}
+
+// ItemEnabled evaluates the when condition of a repeat item, which sees the
+// item values merged over the global variables. Like Enabled it takes the
+// global variables as declared.
+func (inc Include) ItemEnabled(item ListItem, globalVars map[string]interface{}) (bool, error) {
+	if item.When == "" {
+		return true, nil
+	}
+	variables, err := itemVariables(globalVars, item)
+	if err != nil {
+		return false, fmt.Errorf("failed to resolve variables for %s[%s]: %w", inc.File, item.Key, err)
+	}
+	enabled, err := evaluateWhen(item.When, variables)
+	if err != nil {
+		return false, fmt.Errorf("failed to evaluate when of %s[%s]: %w", inc.File, item.Key, err)
+	}
+	return enabled, nil
+}
+
+// enabledChildren returns the children of a repeat item whose when condition
+// holds. Children see the item values merged over the global variables and
+// are named file[key][child].
+func (inc Include) enabledChildren(item ListItem, globalVars map[string]interface{}) ([]ListItem, []SkippedInclude, error) {
+	if len(item.Children) == 0 {
+		return item.Children, nil, nil
+	}
+	variables := parentValues(globalVars, item)
+	parent := Include{File: fmt.Sprintf("%s[%s]", inc.File, item.Key)}
+	var children []ListItem
+	var skipped []SkippedInclude
+	for _, child := range item.Children {
+		enabled, err := parent.ItemEnabled(child, variables)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !enabled {
+			skipped = append(skipped, SkippedInclude{File: parent.File, Key: child.Key, When: child.When})
+			continue
+		}
+		children = append(children, child)
+	}
+	return children, skipped, nil
+}
+
+// ApplyConditions returns the includes whose when condition holds, without
+// the repeat items whose condition does not, along with what was left out.
+// A repeat whose items are all skipped is left out as well. The variables are
+// taken as declared, their references unresolved.
+func ApplyConditions(includes []Include, variables map[string]interface{}) ([]Include, []SkippedInclude, error) {
+	var active []Include
+	var skipped []SkippedInclude
+	for _, inc := range includes {
+		enabled, err := inc.Enabled(variables)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !enabled {
+			skipped = append(skipped, SkippedInclude{File: inc.File, When: inc.When})
+			continue
+		}
+
+		if inc.Repeat != "" && len(inc.List) > 0 {
+			list := make([]ListItem, 0, len(inc.List))
+			for _, item := range inc.List {
+				enabled, err := inc.ItemEnabled(item, variables)
+				if err != nil {
+					return nil, nil, err
+				}
+				if !enabled {
+					skipped = append(skipped, SkippedInclude{File: inc.File, Key: item.Key, When: item.When})
+					continue
+				}
+				children, skippedChildren, err := inc.enabledChildren(item, variables)
+				if err != nil {
+					return nil, nil, err
+				}
+				skipped = append(skipped, skippedChildren...)
+				if inc.ChildRepeat != "" && len(children) == 0 && len(item.Children) > 0 {
+					// Nothing is left to render in the item file
+					continue
+				}
+				item.Children = children
+				list = append(list, item)
+			}
+			if len(list) == 0 {
+				continue
+			}
+			inc.List = list
+		}
+		active = append(active, inc)
+	}
+	return active, skipped, nil
+}
+
+// parseWhen parses a when condition. Like output paths, conditions fail on
+// variables that are not defined instead of silently evaluating to false.
+func parseWhen(when string) (*template.Template, error) {
+	return template.New("when").Funcs(TemplateFuncMap()).Option("missingkey=error").Parse(when)
+}
+
+// evaluateWhen renders a when condition, which must produce true or false.
+// Empty output, e.g. from {{ if .x }}true{{ end }}, counts as false.
+func evaluateWhen(when string, variables map[string]interface{}) (bool, error) {
+	if when == "" {
+		return true, nil
+	}
+
+	tmpl, err := parseWhen(when)
+	if err != nil {
+		return false, err
+	}
+	var result strings.Builder
+	if err := tmpl.Execute(&result, variables); err != nil {
+		return false, err
+	}
+
+	value := strings.TrimSpace(result.String())
+	if value == "" {
+		return false, nil
+	}
+	enabled, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("expected true or false, got %q", value)
+	}
+	return enabled, nil
+}
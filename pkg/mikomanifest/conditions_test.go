@@ -0,0 +1,158 @@
+package mikomanifest
+
+import (
+	"testing"
+)
+
+func TestBuildSkipsDisabledIncludes(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: hpa_enabled
+    value: false
+  - name: pdb_enabled
+    value: "true"
+  - name: replicas
+    value: 3
+include:
+  - file: deployment.yaml
+  - file: hpa.yaml
+    when: "{{ .hpa_enabled }}"
+  - file: pdb.yaml
+    when: '{{ eq .pdb_enabled "true" }}'
+  - file: ha.yaml
+    when: "{{ if gt .replicas 1 }}true{{ end }}"
+  - file: single.yaml
+    when: "{{ if eq .replicas 1 }}true{{ end }}"
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: public
+            value: true
+      - key: internal
+        when: "{{ .public }}"
+        values:
+          - name: public
+            value: false
+  - file: ingress.yaml
+    repeat: same-file
+    list:
+      - key: only
+        when: "false"
+`)
+	for _, name := range []string{"deployment.yaml", "hpa.yaml", "pdb.yaml", "ha.yaml", "single.yaml", "service.yaml", "ingress.yaml"} {
+		h.CreateFile("templates/"+name, "kind: "+name+"\n")
+	}
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+
+	for _, name := range []string{"deployment.yaml", "pdb.yaml", "ha.yaml", "service-api.yaml"} {
+		if !h.FileExists("output/" + name) {
+			t.Errorf("Expected %s to be built", name)
+		}
+	}
+	for _, name := range []string{"hpa.yaml", "single.yaml", "service-internal.yaml", "ingress.yaml"} {
+		if h.FileExists("output/" + name) {
+			t.Errorf("Expected %s to be skipped", name)
+		}
+	}
+
+	// A command line override turns the include back on
+	options := h.GetBuildOptions()
+	options.Variables = map[string]interface{}{"hpa_enabled": true}
+	h.AssertNoError(New(options).Build())
+	if !h.FileExists("output/hpa.yaml") {
+		t.Error("Expected hpa.yaml to be built with hpa_enabled=true")
+	}
+}
+
+func TestSkippedIncludesDoNotCollide(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: cloud
+    value: aws
+include:
+  - file: aws/storage.yaml
+    output: storage.yaml
+    when: '{{ eq .cloud "aws" }}'
+  - file: gcp/storage.yaml
+    output: storage.yaml
+    when: '{{ eq .cloud "gcp" }}'
+`)
+	h.CreateFile("templates/aws/storage.yaml", "provider: aws\n")
+	h.CreateFile("templates/gcp/storage.yaml", "provider: gcp\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/storage.yaml", "provider: aws")
+}
+
+func TestWhenConditionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		expected string
+	}{
+		{
+			name:     "invalid template",
+			include:  "  - file: app.yaml\n    when: \"{{ .enabled \"\n",
+			expected: "app.yaml: invalid when condition",
+		},
+		{
+			name:     "invalid item template",
+			include:  "  - file: app.yaml\n    repeat: same-file\n    list:\n      - key: a\n        when: \"{{ end }}\"\n",
+			expected: "app.yaml[a]: invalid when condition",
+		},
+		{
+			name:     "not a boolean",
+			include:  "  - file: app.yaml\n    when: \"{{ .name }}\"\n",
+			expected: "failed to evaluate when of app.yaml: expected true or false, got \"app\"",
+		},
+		{
+			name:     "undefined variable",
+			include:  "  - file: app.yaml\n    when: \"{{ .hpa_enabled }}\"\n",
+			expected: "map has no entry for key \"hpa_enabled\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "variables:\n  - name: name\n    value: app\ninclude:\n"+tt.include)
+			h.CreateFile("templates/app.yaml", "a: 1\n")
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.expected)
+		})
+	}
+}
+
+func TestConditionsKeepLiteralReferences(t *testing.T) {
+	h := NewTestHelper(t)
+	t.Setenv("MIKO_TEST_PASSWORD", "ab${zz}cd")
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: password
+    valueFrom:
+      env: MIKO_TEST_PASSWORD
+  - name: hpa_enabled
+    value: true
+include:
+  - file: hpa.yaml
+    when: '{{ eq .hpa_enabled "true" }}'
+  - file: secret.yaml
+    repeat: same-file
+    list:
+      - key: db
+        when: "{{ .hpa_enabled }}"
+`)
+	h.CreateFile("templates/hpa.yaml", "kind: HorizontalPodAutoscaler\n")
+	h.CreateFile("templates/secret.yaml", "password: {{ .password }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/hpa.yaml", "kind: HorizontalPodAutoscaler")
+	h.AssertFileContains("output/secret.yaml", "password: ab${zz}cd")
+}
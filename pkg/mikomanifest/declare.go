@@ -0,0 +1,281 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Variable types accepted in declarations
+const (
+	TypeString = "string" // any scalar, rendered as text
+	TypeInt    = "int"
+	TypeFloat  = "float" // int or float
+	TypeBool   = "bool"
+	TypeList   = "list"
+	TypeMap    = "map"
+)
+
+// VariableDeclaration declares a variable an environment must or may provide.
+// Declarations are merged by name across layers, the last one wins.
+type VariableDeclaration struct {
+	Name        string        `yaml:"name"`
+	Type        string        `yaml:"type,omitempty"`
+	Required    bool          `yaml:"required,omitempty"`
+	Default     interface{}   `yaml:"default,omitempty"`
+	Enum        []interface{} `yaml:"enum,omitempty"`
+	Pattern     string        `yaml:"pattern,omitempty"` // Regex matched against the value text
+	Min         *float64      `yaml:"min,omitempty"`     // Minimum number, or minimum length of strings and lists
+	Max         *float64      `yaml:"max,omitempty"`     // Maximum number, or maximum length of strings and lists
+	Description string        `yaml:"description,omitempty"`
+
+	// Origin is where the declaration was made
+	Origin VariableOrigin `yaml:"-"`
+}
+
+// UnmarshalYAML decodes a declaration keeping the YAML type of its default and
+// enum values, the same way variable values are decoded
+func (d *VariableDeclaration) UnmarshalYAML(node *yaml.Node) error {
+	var raw struct {
+		Name        string      `yaml:"name"`
+		Type        string      `yaml:"type"`
+		Required    bool        `yaml:"required"`
+		Default     yaml.Node   `yaml:"default"`
+		Enum        []yaml.Node `yaml:"enum"`
+		Pattern     string      `yaml:"pattern"`
+		Min         *float64    `yaml:"min"`
+		Max         *float64    `yaml:"max"`
+		Description string      `yaml:"description"`
+	}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	if raw.Default.Kind != 0 {
+		value, err := decodeValue(&raw.Default)
+		if err != nil {
+			return fmt.Errorf("invalid default for variable %s: %w", raw.Name, err)
+		}
+		d.Default = value
+	}
+
+	for i := range raw.Enum {
+		value, err := decodeValue(&raw.Enum[i])
+		if err != nil {
+			return fmt.Errorf("invalid enum for variable %s: %w", raw.Name, err)
+		}
+		d.Enum = append(d.Enum, value)
+	}
+
+	d.Name = raw.Name
+	d.Type = raw.Type
+	d.Required = raw.Required
+	d.Pattern = raw.Pattern
+	d.Min = raw.Min
+	d.Max = raw.Max
+	d.Description = raw.Description
+	d.Origin = VariableOrigin{Line: node.Line}
+	return nil
+}
+
+// FindDeclaration returns the merged declaration of a variable
+func (c *Config) FindDeclaration(name string) (*VariableDeclaration, bool) {
+	for i := range c.Declare {
+		if c.Declare[i].Name == name {
+			return &c.Declare[i], true
+		}
+	}
+	return nil, false
+}
+
+// validateDeclarations checks the declarations of a single config file
+func validateDeclarations(config *Config) error {
+	seen := make(map[string]bool)
+	for _, d := range config.Declare {
+		if d.Name == "" {
+			return fmt.Errorf("line %d: declaration without a name", d.Origin.Line)
+		}
+		if seen[d.Name] {
+			return fmt.Errorf("variable %s is declared more than once", d.Name)
+		}
+		seen[d.Name] = true
+
+		switch d.Type {
+		case "", TypeString, TypeInt, TypeFloat, TypeBool, TypeList, TypeMap:
+		default:
+			return fmt.Errorf("variable %s: unknown type %q (expected %s)", d.Name, d.Type,
+				strings.Join([]string{TypeString, TypeInt, TypeFloat, TypeBool, TypeList, TypeMap}, ", "))
+		}
+		if d.Pattern != "" {
+			if _, err := regexp.Compile(d.Pattern); err != nil {
+				return fmt.Errorf("variable %s: invalid pattern: %w", d.Name, err)
+			}
+		}
+		if d.Min != nil && d.Max != nil && *d.Min > *d.Max {
+			return fmt.Errorf("variable %s: min %v is greater than max %v", d.Name, *d.Min, *d.Max)
+		}
+	}
+	return nil
+}
+
+// applyDeclarationDefaults adds the declared variables missing from a merged
+// config with their default value
+func (c *Config) applyDeclarationDefaults() {
+	for _, d := range c.Declare {
+		if d.Default == nil {
+			continue
+		}
+		if _, found := c.FindVariable(d.Name); found {
+			continue
+		}
+		origin := d.Origin
+		origin.Value = d.Default
+		c.Variables = append(c.Variables, Variable{
+			Name:    d.Name,
+			Value:   d.Default,
+			Origins: []VariableOrigin{origin},
+		})
+	}
+}
+
+// ValidateDeclarations checks the variables of a merged config against its
+// declarations and returns every violation found. Values of sensitive
+// variables are masked in the messages.
+func (c *Config) ValidateDeclarations() []string {
+	var violations []string
+	for _, d := range c.Declare {
+		v, found := c.FindVariable(d.Name)
+		if !found || v.Value == "" {
+			if d.Required {
+				violations = append(violations, fmt.Sprintf("%s: required variable is not defined", d.Name))
+			}
+			continue
+		}
+
+		display := v.DisplayValue()
+		if problem := d.check(v.Value, display); problem != "" {
+			violations = append(violations, fmt.Sprintf("%s: %s", d.Name, problem))
+		}
+	}
+	return violations
+}
+
+// CheckDeclarations validates the declarations of a merged config once the
+// command line overrides are applied and references are resolved. The config
+// itself is left untouched.
+func CheckDeclarations(config *Config, overrides map[string]interface{}) error {
+	if len(config.Declare) == 0 {
+		return nil
+	}
+
+	checked := *config
+	checked.Variables = append([]Variable{}, config.Variables...)
+	ApplyVariableOverrides(&checked, overrides)
+	if err := ResolveConfigVariables(&checked); err != nil {
+		return err
+	}
+
+	if violations := checked.ValidateDeclarations(); len(violations) > 0 {
+		return fmt.Errorf("%d variable declaration violation(s): %s", len(violations), strings.Join(violations, "; "))
+	}
+	return nil
+}
+
+// check returns the first constraint the value breaks, or "" if it satisfies all
+func (d *VariableDeclaration) check(value interface{}, display string) string {
+	if d.Type != "" && !matchesType(value, d.Type) {
+		return fmt.Sprintf("expected %s, got %s %s", d.Type, valueTypeName(value), display)
+	}
+
+	if len(d.Enum) > 0 {
+		allowed := make([]string, 0, len(d.Enum))
+		match := false
+		for _, option := range d.Enum {
+			text := FormatVariableValue(option)
+			allowed = append(allowed, text)
+			if text == FormatVariableValue(value) {
+				match = true
+			}
+		}
+		if !match {
+			return fmt.Sprintf("value %s is not one of [%s]", display, strings.Join(allowed, ", "))
+		}
+	}
+
+	if d.Pattern != "" {
+		if re, err := regexp.Compile(d.Pattern); err == nil && !re.MatchString(FormatVariableValue(value)) {
+			return fmt.Sprintf("value %s does not match pattern %s", display, d.Pattern)
+		}
+	}
+
+	size, what := measure(value)
+	if what == "" {
+		return ""
+	}
+	if d.Min != nil && size < *d.Min {
+		return fmt.Sprintf("%s %s is below the minimum %v", what, measureDisplay(size, what, display), *d.Min)
+	}
+	if d.Max != nil && size > *d.Max {
+		return fmt.Sprintf("%s %s is above the maximum %v", what, measureDisplay(size, what, display), *d.Max)
+	}
+	return ""
+}
+
+// matchesType reports whether a value has the declared type. Strings accept
+// any scalar and floats accept integers.
+func matchesType(value interface{}, typeName string) bool {
+	actual := valueTypeName(value)
+	switch typeName {
+	case TypeString:
+		return actual != TypeList && actual != TypeMap
+	case TypeFloat:
+		return actual == TypeFloat || actual == TypeInt
+	default:
+		return actual == typeName
+	}
+}
+
+// valueTypeName names the type of a variable value in messages
+func valueTypeName(value interface{}) string {
+	switch value.(type) {
+	case int:
+		return TypeInt
+	case float64:
+		return TypeFloat
+	case bool:
+		return TypeBool
+	case []interface{}:
+		return TypeList
+	case map[string]interface{}:
+		return TypeMap
+	default:
+		return TypeString
+	}
+}
+
+// measure returns the number compared with min/max: the value of numbers and
+// the length of strings and lists
+func measure(value interface{}) (float64, string) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), "value"
+	case float64:
+		return v, "value"
+	case string:
+		return float64(len(v)), "length"
+	case []interface{}:
+		return float64(len(v)), "length"
+	default:
+		return 0, ""
+	}
+}
+
+// measureDisplay formats the measured number, keeping masked values hidden
+func measureDisplay(size float64, what, display string) string {
+	if what == "value" {
+		return display
+	}
+	return fmt.Sprint(size)
+}
@@ -0,0 +1,234 @@
+package mikomanifest
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestValidateDeclarations(t *testing.T) {
+	content := `declare:
+  - name: replicas
+    type: int
+    min: 1
+    max: 10
+  - name: log_level
+    enum: [debug, info]
+  - name: image_tag
+    pattern: '^v\d+\.\d+$'
+  - name: ratio
+    type: float
+  - name: hosts
+    type: list
+    min: 1
+  - name: region
+    required: true
+  - name: db_password
+    type: string
+    max: 4
+variables:
+  - name: replicas
+    value: 20
+  - name: log_level
+    value: trace
+  - name: image_tag
+    value: latest
+  - name: ratio
+    value: 2
+  - name: hosts
+    value: []
+  - name: db_password
+    sensitive: true
+    value: hunter22
+`
+
+	var config Config
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := validateDeclarations(&config); err != nil {
+		t.Fatalf("Expected valid declarations, got: %v", err)
+	}
+
+	expected := []string{
+		"replicas: value 20 is above the maximum 10",
+		"log_level: value trace is not one of [debug, info]",
+		`image_tag: value latest does not match pattern ^v\d+\.\d+$`,
+		"hosts: length 0 is below the minimum 1",
+		"region: required variable is not defined",
+		"db_password: length 8 is above the maximum 4",
+	}
+	if got := config.ValidateDeclarations(); !reflect.DeepEqual(got, expected) {
+		t.Errorf("Expected violations:\n%q\nGot:\n%q", expected, got)
+	}
+
+	config.Variables[0].Value = "three"
+	if got := config.ValidateDeclarations()[0]; got != "replicas: expected int, got string three" {
+		t.Errorf("Unexpected type violation: %s", got)
+	}
+}
+
+func TestValidateDeclarationsSyntax(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown type", "declare:\n  - name: a\n    type: integer\n", "unknown type"},
+		{"bad pattern", "declare:\n  - name: a\n    pattern: '['\n", "invalid pattern"},
+		{"min above max", "declare:\n  - name: a\n    min: 5\n    max: 1\n", "greater than max"},
+		{"duplicate", "declare:\n  - name: a\n  - name: a\n", "declared more than once"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			var config Config
+			h.AssertNoError(yaml.Unmarshal([]byte(tt.content), &config))
+			h.AssertErrorContains(validateDeclarations(&config), tt.wantErr)
+		})
+	}
+}
+
+func TestDeclarationDefaultsAcrossLayers(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+declare:
+  - name: replicas
+    type: int
+    default: 1
+  - name: log_level
+    default: info
+    description: Application log level
+`)
+	h.CreateFile("config/prod.yaml", `---
+resources:
+  - base.yaml
+declare:
+  - name: replicas
+    type: int
+    required: true
+    min: 3
+variables:
+  - name: replicas
+    value: 2
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "prod", false)
+	h.AssertNoError(err)
+
+	logLevel, found := config.FindVariable("log_level")
+	if !found || logLevel.Value != "info" {
+		t.Fatalf("Expected default log_level=info, got %#v", logLevel)
+	}
+	if origin := logLevel.Origins[0]; origin.File != filepath.Join(h.TempDir(), "config", "base.yaml") || origin.Line != 6 {
+		t.Errorf("Expected default origin base.yaml:6, got %s", origin)
+	}
+
+	if d, _ := config.FindDeclaration("replicas"); !d.Required || d.Default != nil {
+		t.Errorf("Expected prod declaration to replace the base one, got %+v", d)
+	}
+
+	// Enforced after command line overrides
+	h.AssertErrorContains(CheckDeclarations(config, nil), "replicas: value 2 is below the minimum 3")
+	h.AssertNoError(CheckDeclarations(config, map[string]interface{}{"replicas": 3}))
+	h.AssertErrorContains(CheckDeclarations(config, map[string]interface{}{"replicas": "many"}), "expected int")
+	if replicas, _ := config.FindVariable("replicas"); replicas.Value != 2 {
+		t.Error("Expected CheckDeclarations to leave the config untouched")
+	}
+}
+
+func TestCheckReportsDeclarationViolationsPerEnvironment(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+declare:
+  - name: region
+    required: true
+  - name: replicas
+    type: int
+`)
+	h.CreateFile("config/dev.yaml", `---
+resources:
+  - base.yaml
+variables:
+  - name: region
+    value: eu-west-1
+`)
+	h.CreateFile("config/prod.yaml", `---
+resources:
+  - base.yaml
+variables:
+  - name: replicas
+    value: lots
+`)
+
+	configDir := filepath.Join(h.TempDir(), "config")
+	environments, err := DetectEnvironments(configDir)
+	h.AssertNoError(err)
+	if !reflect.DeepEqual(environments, []string{"dev", "prod"}) {
+		t.Errorf("Expected environments [dev prod], got %v", environments)
+	}
+
+	var checkErr error
+	out := h.CaptureOutput(func() {
+		checkErr = CheckConfigDirectory(CheckOptions{ConfigDir: configDir})
+	})
+	h.AssertErrorContains(checkErr, "environment configuration validation failed")
+	h.AssertStringContains(out, "prod.yaml - region: required variable is not defined")
+	h.AssertStringContains(out, "prod.yaml - replicas: expected int, got string lots")
+	h.AssertStringContains(out, "dev.yaml - 2 declared variable(s) satisfied")
+
+	h.AssertNoError(CheckConfigDirectory(CheckOptions{ConfigDir: configDir, Environments: []string{"dev"}}))
+}
+
+func TestBuildFailsOnDeclarationViolations(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+declare:
+  - name: image_tag
+    required: true
+include:
+  - file: app.yaml
+`)
+	h.CreateFile("templates/app.yaml", "image: app:{{.image_tag}}\n")
+
+	options := h.GetBuildOptions()
+	h.AssertErrorContains(New(options).Build(), "image_tag: required variable is not defined")
+
+	options.Variables = map[string]interface{}{"image_tag": "1.2.3"}
+	h.AssertNoError(New(options).Build())
+	h.AssertFileContains("output/app.yaml", "image: app:1.2.3")
+}
+
+func TestCheckWarnsOnUnavailableInputs(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/dev.yaml", `---
+variables:
+  - name: image_tag
+    valueFrom:
+      env: MIKO_TEST_SURELY_UNSET
+`)
+	h.CreateFile("config/prod.yaml", `---
+declare:
+  - name: region
+    required: true
+variables:
+  - name: region
+    value: eu-west-1
+`)
+
+	var err error
+	out := h.CaptureOutput(func() {
+		err = CheckConfigDirectory(CheckOptions{ConfigDir: filepath.Join(h.TempDir(), "config")})
+	})
+	h.AssertNoError(err)
+	h.AssertStringContains(out, "dev.yaml - Skipped environment dev, it cannot be loaded here")
+	h.AssertStringContains(out, "environment variable MIKO_TEST_SURELY_UNSET is not set")
+	h.AssertStringContains(out, "prod.yaml - 1 declared variable(s) satisfied")
+}
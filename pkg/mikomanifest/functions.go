@@ -0,0 +1,389 @@
+package mikomanifest
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Function categories shown by the functions command
+const (
+	CategoryStrings     = "strings"
+	CategoryDefaults    = "defaults"
+	CategoryComparison  = "comparison"
+	CategoryEncoding    = "encoding"
+	CategoryCollections = "collections"
+	CategoryConversion  = "conversion"
+	CategoryDates       = "dates"
+	CategoryTemplates   = "templates"
+)
+
+// TemplateFunction describes a function available in templates. Names and
+// argument order follow sprig where a sprig function exists, so the last
+// argument is the one usually piped in.
+type TemplateFunction struct {
+	Name        string
+	Category    string
+	Usage       string
+	Description string
+	fn          interface{}
+}
+
+// templateFunctions is the curated function library, in display order
+var templateFunctions = []TemplateFunction{
+	{"upper", CategoryStrings, "upper STRING", "Convert to upper case", strings.ToUpper},
+	{"lower", CategoryStrings, "lower STRING", "Convert to lower case", strings.ToLower},
+	{"trim", CategoryStrings, "trim STRING", "Remove leading and trailing white space", strings.TrimSpace},
+	{"trimPrefix", CategoryStrings, "trimPrefix PREFIX STRING", "Remove a leading prefix", func(prefix, s string) string { return strings.TrimPrefix(s, prefix) }},
+	{"trimSuffix", CategoryStrings, "trimSuffix SUFFIX STRING", "Remove a trailing suffix", func(suffix, s string) string { return strings.TrimSuffix(s, suffix) }},
+	{"replace", CategoryStrings, "replace OLD NEW STRING", "Replace every occurrence of OLD with NEW", func(old, replacement, s string) string { return strings.ReplaceAll(s, old, replacement) }},
+	{"contains", CategoryStrings, "contains SUBSTRING STRING", "Report whether STRING contains SUBSTRING", func(substr, s string) bool { return strings.Contains(s, substr) }},
+	{"hasPrefix", CategoryStrings, "hasPrefix PREFIX STRING", "Report whether STRING starts with PREFIX", func(prefix, s string) bool { return strings.HasPrefix(s, prefix) }},
+	{"hasSuffix", CategoryStrings, "hasSuffix SUFFIX STRING", "Report whether STRING ends with SUFFIX", func(suffix, s string) bool { return strings.HasSuffix(s, suffix) }},
+	{"trunc", CategoryStrings, "trunc LENGTH STRING", "Keep the first LENGTH characters", truncate},
+	{"repeat", CategoryStrings, "repeat COUNT STRING", "Repeat STRING COUNT times", func(count int, s string) string { return strings.Repeat(s, count) }},
+	{"quote", CategoryStrings, "quote VALUE...", "Wrap each value in double quotes, escaping as needed", quote},
+	{"squote", CategoryStrings, "squote VALUE...", "Wrap each value in single quotes", squote},
+	{"indent", CategoryStrings, "indent SPACES STRING", "Indent every line by SPACES spaces", indent},
+	{"nindent", CategoryStrings, "nindent SPACES STRING", "Like indent, with a leading new line", func(spaces int, s string) string { return "\n" + indent(spaces, s) }},
+	{"regexMatch", CategoryStrings, "regexMatch REGEX STRING", "Report whether STRING matches REGEX", regexMatch},
+	{"regexReplaceAll", CategoryStrings, "regexReplaceAll REGEX STRING REPLACEMENT", "Replace the matches of REGEX, $1 expands to groups", regexReplaceAll},
+
+	{"default", CategoryDefaults, "default DEFAULT VALUE", "VALUE, or DEFAULT if VALUE is empty", defaultValue},
+	{"empty", CategoryDefaults, "empty VALUE", "Report whether VALUE is nil, zero, false or has no elements", isEmpty},
+	{"coalesce", CategoryDefaults, "coalesce VALUE...", "The first value that is not empty", coalesce},
+	{"ternary", CategoryDefaults, "ternary TRUE FALSE CONDITION", "TRUE if CONDITION holds, FALSE otherwise", ternary},
+	{"required", CategoryDefaults, "required MESSAGE VALUE", "VALUE, failing the build with MESSAGE if it is nil or an empty string", required},
+
+	// Replace the built-ins so typed values still equal their text
+	{"eq", CategoryComparison, "eq VALUE OTHER...", "Report whether VALUE equals any OTHER; a number or boolean equals its text (3 and \"3\")", equal},
+	{"ne", CategoryComparison, "ne VALUE OTHER", "Report whether VALUE differs from OTHER, like not (eq VALUE OTHER)", func(a, b interface{}) bool { return !equal(a, b) }},
+
+	{"b64enc", CategoryEncoding, "b64enc STRING", "Encode to base64", func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }},
+	{"b64dec", CategoryEncoding, "b64dec STRING", "Decode from base64", b64dec},
+	{"sha256sum", CategoryEncoding, "sha256sum STRING", "Hex encoded SHA-256 digest", sha256sum},
+	{"toYaml", CategoryEncoding, "toYaml VALUE", "Encode as YAML, without the trailing new line", toYaml},
+	{"toJson", CategoryEncoding, "toJson VALUE", "Encode as compact JSON", toJSON},
+
+	{"list", CategoryCollections, "list VALUE...", "Build a list", func(values ...interface{}) []interface{} { return values }},
+	{"dict", CategoryCollections, "dict KEY VALUE...", "Build a map from key/value pairs", dict},
+	{"hasKey", CategoryCollections, "hasKey MAP KEY", "Report whether MAP has KEY", hasKey},
+	{"keys", CategoryCollections, "keys MAP", "Sorted keys of MAP", keys},
+	{"join", CategoryCollections, "join SEPARATOR LIST", "Join the elements of LIST as text", join},
+	{"splitList", CategoryCollections, "splitList SEPARATOR STRING", "Split STRING into a list", func(sep, s string) []string { return strings.Split(s, sep) }},
+
+	{"toString", CategoryConversion, "toString VALUE", "Format VALUE as text, the way it renders", toString},
+	{"toInt", CategoryConversion, "toInt VALUE", "Convert a number or numeric string to an integer", toInt},
+
+	{"now", CategoryDates, "now", "Current local time", time.Now},
+	{"date", CategoryDates, "date LAYOUT TIME", "Format a time (or unix seconds) with a Go layout such as \"2006-01-02\"", formatDate},
+	{"dateInZone", CategoryDates, "dateInZone LAYOUT TIME ZONE", "Like date, in an IANA time zone such as \"UTC\"", formatDateInZone},
+
+	// Bound to its template set by newTemplate
+	{"include", CategoryTemplates, "include NAME DATA", "Output of a {{define}} block as text, so it can be piped to indent", unboundInclude},
+}
+
+// TemplateFunctions returns the functions available in templates
+func TemplateFunctions() []TemplateFunction {
+	return append([]TemplateFunction{}, templateFunctions...)
+}
+
+// TemplateFuncMap returns the function library registered on every template
+func TemplateFuncMap() template.FuncMap {
+	funcs := make(template.FuncMap, len(templateFunctions))
+	for _, f := range templateFunctions {
+		funcs[f.Name] = f.fn
+	}
+	return funcs
+}
+
+func unboundInclude(name string, data interface{}) (string, error) {
+	return "", fmt.Errorf("include %s: no template set to include from", name)
+}
+
+func truncate(length int, s string) string {
+	runes := []rune(s)
+	if length < 0 || length >= len(runes) {
+		return s
+	}
+	return string(runes[:length])
+}
+
+func quote(values ...interface{}) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			quoted = append(quoted, strconv.Quote(toString(v)))
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func squote(values ...interface{}) string {
+	quoted := make([]string, 0, len(values))
+	for _, v := range values {
+		if v != nil {
+			quoted = append(quoted, "'"+toString(v)+"'")
+		}
+	}
+	return strings.Join(quoted, " ")
+}
+
+func indent(spaces int, s string) string {
+	pad := strings.Repeat(" ", spaces)
+	return pad + strings.ReplaceAll(s, "\n", "\n"+pad)
+}
+
+func regexMatch(expr, s string) (bool, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(s), nil
+}
+
+func regexReplaceAll(expr, s, replacement string) (string, error) {
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return "", err
+	}
+	return re.ReplaceAllString(s, replacement), nil
+}
+
+func defaultValue(def interface{}, given ...interface{}) interface{} {
+	if len(given) == 0 || isEmpty(given[0]) {
+		return def
+	}
+	return given[0]
+}
+
+// isEmpty reports whether a value is nil, the zero value of its type or a
+// list or map without elements
+func isEmpty(value interface{}) bool {
+	if value == nil {
+		return true
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Ptr, reflect.Interface:
+		return v.IsNil()
+	default:
+		return v.IsZero()
+	}
+}
+
+func coalesce(values ...interface{}) interface{} {
+	for _, v := range values {
+		if !isEmpty(v) {
+			return v
+		}
+	}
+	return nil
+}
+
+func ternary(whenTrue, whenFalse interface{}, condition bool) interface{} {
+	if condition {
+		return whenTrue
+	}
+	return whenFalse
+}
+
+func required(message string, value interface{}) (interface{}, error) {
+	if value == nil {
+		return nil, errors.New(message)
+	}
+	if s, ok := value.(string); ok && s == "" {
+		return nil, errors.New(message)
+	}
+	return value, nil
+}
+
+func b64dec(s string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", err
+	}
+	return string(decoded), nil
+}
+
+func sha256sum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func toYaml(value interface{}) (string, error) {
+	data, err := yaml.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(data), "\n"), nil
+}
+
+func toJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func dict(pairs ...interface{}) (map[string]interface{}, error) {
+	if len(pairs)%2 != 0 {
+		return nil, errors.New("dict expects key/value pairs")
+	}
+	m := make(map[string]interface{}, len(pairs)/2)
+	for i := 0; i < len(pairs); i += 2 {
+		m[toString(pairs[i])] = pairs[i+1]
+	}
+	return m, nil
+}
+
+func hasKey(m map[string]interface{}, key string) bool {
+	_, ok := m[key]
+	return ok
+}
+
+func keys(m map[string]interface{}) []string {
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func join(sep string, list interface{}) string {
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return toString(list)
+	}
+	parts := make([]string, 0, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		parts = append(parts, toString(v.Index(i).Interface()))
+	}
+	return strings.Join(parts, sep)
+}
+
+// equal is the eq built-in, except that a number or boolean equals its text
+func equal(value interface{}, others ...interface{}) bool {
+	for _, other := range others {
+		if valuesEqual(value, other) {
+			return true
+		}
+	}
+	return false
+}
+
+func valuesEqual(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	_, aIsString := a.(string)
+	_, bIsString := b.(string)
+	if aIsString || bIsString {
+		return isScalar(a) && isScalar(b) && toString(a) == toString(b)
+	}
+	if x, ok := toFloat(a); ok {
+		y, ok := toFloat(b)
+		return ok && x == y
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+// isScalar reports whether a value is a string, number or boolean
+func isScalar(value interface{}) bool {
+	switch reflect.ValueOf(value).Kind() {
+	case reflect.String, reflect.Bool,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// toFloat converts any number to float64
+func toFloat(value interface{}) (float64, bool) {
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// toString formats a value the same way it is rendered in a template
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case fmt.Stringer:
+		return v.String()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+func toInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case int64:
+		return int(v), nil
+	case float64:
+		return int(v), nil
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	default:
+		return strconv.Atoi(strings.TrimSpace(toString(v)))
+	}
+}
+
+func formatDate(layout string, date interface{}) (string, error) {
+	return formatDateInZone(layout, date, "Local")
+}
+
+func formatDateInZone(layout string, date interface{}, zone string) (string, error) {
+	location, err := time.LoadLocation(zone)
+	if err != nil {
+		return "", err
+	}
+
+	var t time.Time
+	switch v := date.(type) {
+	case time.Time:
+		t = v
+	case *time.Time:
+		t = *v
+	case int:
+		t = time.Unix(int64(v), 0)
+	case int64:
+		t = time.Unix(v, 0)
+	default:
+		return "", fmt.Errorf("date expects a time or unix seconds, got %T", date)
+	}
+	return t.In(location).Format(layout), nil
+}
@@ -0,0 +1,147 @@
+package mikomanifest
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTemplateFunctions(t *testing.T) {
+	m := New(BuildOptions{})
+	variables := map[string]interface{}{
+		"name":    "my-app",
+		"empty":   "",
+		"zero":    0,
+		"port":    8080,
+		"ratio":   1.5,
+		"enabled": true,
+		"hosts":   []interface{}{"a.local", "b.local"},
+		"labels":  map[string]interface{}{"tier": "web", "app": "my-app"},
+		"created": 1700000000,
+	}
+
+	tests := []struct {
+		function string
+		template string
+		expected string
+	}{
+		{"upper", `{{ .name | upper }}`, "MY-APP"},
+		{"lower", `{{ "My-App" | lower }}`, "my-app"},
+		{"trim", `{{ "  x  " | trim }}`, "x"},
+		{"trimPrefix", `{{ .name | trimPrefix "my-" }}`, "app"},
+		{"trimSuffix", `{{ .name | trimSuffix "-app" }}`, "my"},
+		{"replace", `{{ .name | replace "-" "_" }}`, "my_app"},
+		{"contains", `{{ contains "app" .name }}`, "true"},
+		{"hasPrefix", `{{ hasPrefix "my" .name }}`, "true"},
+		{"hasSuffix", `{{ hasSuffix "my" .name }}`, "false"},
+		{"trunc", `{{ .name | trunc 2 }}|{{ .name | trunc 20 }}`, "my|my-app"},
+		{"repeat", `{{ "ab" | repeat 3 }}`, "ababab"},
+		{"quote", `{{ .port | quote }} {{ quote "a\"b" .name }}`, `"8080" "a\"b" "my-app"`},
+		{"squote", `{{ .name | squote }}`, "'my-app'"},
+		{"indent", `{{ "a: 1\nb: 2" | indent 2 }}`, "  a: 1\n  b: 2"},
+		{"nindent", `x:{{ "a: 1" | nindent 4 }}`, "x:\n    a: 1"},
+		{"regexMatch", `{{ regexMatch "^[a-z-]+$" .name }}`, "true"},
+		{"regexReplaceAll", `{{ regexReplaceAll "(\\w+)-(\\w+)" .name "$2-$1" }}`, "app-my"},
+		{"default", `{{ .empty | default "none" }} {{ .zero | default 1 }} {{ .name | default "none" }}`, "none 1 my-app"},
+		{"empty", `{{ empty .empty }} {{ empty .hosts }} {{ empty .enabled }}`, "true false false"},
+		{"coalesce", `{{ coalesce .empty .zero .name }}`, "my-app"},
+		{"ternary", `{{ ternary "on" "off" .enabled }}`, "on"},
+		{"required", `{{ required "name is required" .name }}`, "my-app"},
+		{"eq", `{{ eq .port "8080" }} {{ eq .enabled "true" }} {{ eq .name "x" "my-app" }} {{ eq .port 8080.0 }} {{ eq .hosts "a.local" }}`, "true true true true false"},
+		{"ne", `{{ ne .port "8080" }} {{ ne .name "other" }}`, "false true"},
+		{"b64enc", `{{ .name | b64enc }}`, "bXktYXBw"},
+		{"b64dec", `{{ "bXktYXBw" | b64dec }}`, "my-app"},
+		{"sha256sum", `{{ .name | sha256sum | trunc 12 }}`, "4c9a75cca717"},
+		{"toYaml", `{{ .labels | toYaml }}`, "app: my-app\ntier: web"},
+		{"toJson", `{{ .hosts | toJson }}`, `["a.local","b.local"]`},
+		{"list", `{{ list 1 "two" | toJson }}`, `[1,"two"]`},
+		{"dict", `{{ dict "a" 1 "b" .name | toJson }}`, `{"a":1,"b":"my-app"}`},
+		{"hasKey", `{{ hasKey .labels "tier" }} {{ hasKey .labels "env" }}`, "true false"},
+		{"keys", `{{ keys .labels }}`, "[app tier]"},
+		{"join", `{{ join "," .hosts }}`, "a.local,b.local"},
+		{"splitList", `{{ splitList "." "a.b.c" | join "/" }}`, "a/b/c"},
+		{"toString", `{{ .ratio | toString | quote }}`, `"1.5"`},
+		{"toInt", `{{ toInt "41" }}|{{ toInt 2.9 }}`, "41|2"},
+		{"now", `{{ if now.IsZero }}zero{{ else }}set{{ end }}`, "set"},
+		{"date", `{{ .created | date "2006" }}`, "2023"},
+		{"dateInZone", `{{ dateInZone "15:04 MST" .created "UTC" }}`, "22:13 UTC"},
+		{"include", `{{ define "name" }}{{ .name }}{{ end }}{{ include "name" . | upper }}`, "MY-APP"},
+	}
+
+	tested := make(map[string]bool)
+	for _, tt := range tests {
+		tested[tt.function] = true
+		t.Run(tt.function, func(t *testing.T) {
+			result, err := m.RenderTemplate(tt.template, variables, tt.function)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+
+	for _, f := range TemplateFunctions() {
+		if !tested[f.Name] {
+			t.Errorf("Function %s has no test case", f.Name)
+		}
+	}
+}
+
+func TestTemplateFunctionErrors(t *testing.T) {
+	m := New(BuildOptions{})
+	variables := map[string]interface{}{"empty": "", "name": "my-app"}
+
+	tests := []struct {
+		template string
+		wantErr  string
+	}{
+		{`{{ required "image_tag must be set" .empty }}`, "image_tag must be set"},
+		{`{{ "%%%" | b64dec }}`, "illegal base64"},
+		{`{{ dict "a" }}`, "key/value pairs"},
+		{`{{ toInt .name }}`, "invalid syntax"},
+		{`{{ date "2006" .name }}`, "date expects a time or unix seconds"},
+		{`{{ regexMatch "[" .name }}`, "missing closing ]"},
+	}
+
+	for _, tt := range tests {
+		_, err := m.RenderTemplate(tt.template, variables, "errors.yaml")
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: expected error containing %q, got: %v", tt.template, tt.wantErr, err)
+		}
+	}
+}
+
+func TestTemplateFunctionsInIncludeModes(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: app_name
+    value: my-app
+include:
+  - file: configmap.yaml
+  - file: service.yaml
+    repeat: same-file
+    list:
+      - key: api
+        values:
+          - name: port
+            value: 80
+  - file: secret.yaml
+    repeat: multiple-files
+    list:
+      - key: db
+        values:
+          - name: password
+            value: hunter22
+`)
+	h.CreateFile("templates/configmap.yaml", "name: {{ .app_name | upper | quote }}\n")
+	h.CreateFile("templates/service.yaml", "port: {{ .port | default 8080 }}\n")
+	h.CreateFile("templates/secret.yaml", "password: {{ .password | b64enc }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/configmap.yaml", `name: "MY-APP"`)
+	h.AssertFileContains("output/service.yaml", "port: 80")
+	h.AssertFileContains("output/secret-db.yaml", "password: aHVudGVyMjI=")
+}
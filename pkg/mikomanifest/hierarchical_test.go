@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -131,7 +132,7 @@ data:
 		OutputDir:    outputDir,
 		ConfigDir:    configDir,
 		TemplatesDir: templatesDir,
-		Variables:    make(map[string]string),
+		Variables:    make(map[string]interface{}),
 	}
 
 	mikoManifest := New(options)
@@ -141,7 +142,7 @@ data:
 	}
 
 	// Verify that variables from all levels are merged correctly
-	variableMap := make(map[string]string)
+	variableMap := make(map[string]interface{})
 	for _, v := range config.Variables {
 		variableMap[v.Name] = v.Value
 	}
@@ -262,7 +263,7 @@ variables:
 		ConfigDir:    configDir,
 		TemplatesDir: tempDir,
 		OutputDir:    tempDir,
-		Variables:    make(map[string]string),
+		Variables:    make(map[string]interface{}),
 	}
 
 	mikoManifest := New(options)
@@ -315,7 +316,7 @@ variables:
 		ConfigDir:    configDir,
 		TemplatesDir: tempDir,
 		OutputDir:    tempDir,
-		Variables:    make(map[string]string),
+		Variables:    make(map[string]interface{}),
 	}
 
 	mikoManifest := New(options)
@@ -347,3 +348,494 @@ func containsInMiddle(s, substr string) bool {
 	}
 	return false
 }
+
+func TestDeepMergeNestedVariables(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base/db.yaml", `---
+variables:
+  - name: db
+    value:
+      host: db.internal
+      pool:
+        size: 5
+        timeout: 30s
+  - name: hosts
+    value: [a.example.com]
+`)
+
+	h.CreateFile("config/prod.yaml", `---
+resources:
+  - base/
+merge:
+  lists: append
+variables:
+  - name: db
+    value:
+      pool:
+        size: 20
+  - name: hosts
+    value: [b.example.com]
+`)
+
+	m := New(BuildOptions{ConfigDir: filepath.Join(h.TempDir(), "config")})
+	config, err := m.LoadConfig("prod")
+	h.AssertNoError(err)
+
+	variables := m.MergeVariables(config.Variables, nil, nil)
+
+	expectedDB := map[string]interface{}{
+		"host": "db.internal",
+		"pool": map[string]interface{}{"size": 20, "timeout": "30s"},
+	}
+	if !reflect.DeepEqual(variables["db"], expectedDB) {
+		t.Errorf("Expected db to be %#v, got %#v", expectedDB, variables["db"])
+	}
+
+	expectedHosts := []interface{}{"a.example.com", "b.example.com"}
+	if !reflect.DeepEqual(variables["hosts"], expectedHosts) {
+		t.Errorf("Expected hosts to be %#v, got %#v", expectedHosts, variables["hosts"])
+	}
+}
+
+func TestPatchReplaceMarkerRemoved(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/dev.yaml", `---
+variables:
+  - name: db
+    value:
+      $patch: replace
+      host: localhost
+`)
+
+	m := New(BuildOptions{ConfigDir: filepath.Join(h.TempDir(), "config")})
+	config, err := m.LoadConfig("dev")
+	h.AssertNoError(err)
+
+	expected := map[string]interface{}{"host": "localhost"}
+	if !reflect.DeepEqual(config.Variables[0].Value, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, config.Variables[0].Value)
+	}
+}
+
+func TestMergedConfigDeclarationOrder(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+variables:
+  - name: app_name
+    value: app
+  - name: replicas
+    value: "1"
+  - name: image
+    value: nginx
+  - name: tag
+    value: latest
+include:
+  - file: deployment.yaml
+  - file: service.yaml
+`)
+	h.CreateFile("config/components/a.yaml", `---
+variables:
+  - name: monitoring
+    value: "true"
+include:
+  - file: servicemonitor.yaml
+`)
+	h.CreateFile("config/components/b.yaml", `---
+variables:
+  - name: ingress_host
+    value: app.example.com
+include:
+  - file: ingress.yaml
+`)
+	h.CreateFile("config/dev.yaml", `---
+resources:
+  - base.yaml
+  - components/
+variables:
+  - name: tag
+    value: dev
+  - name: environment
+    value: development
+  - name: replicas
+    value: "2"
+include:
+  - file: configmap.yaml
+  - file: deployment.yaml
+`)
+
+	for _, name := range []string{"deployment.yaml", "service.yaml", "servicemonitor.yaml", "ingress.yaml", "configmap.yaml"} {
+		h.CreateFile("templates/"+name, "---\nkind: ConfigMap\nmetadata:\n  name: "+name+"\n")
+	}
+
+	expectedVariables := []string{"app_name=app", "replicas=2", "image=nginx", "tag=dev", "monitoring=true", "ingress_host=app.example.com", "environment=development"}
+	expectedIncludes := []string{"deployment.yaml", "service.yaml", "servicemonitor.yaml", "ingress.yaml", "configmap.yaml"}
+
+	options := h.GetBuildOptions()
+	options.Environment = "dev"
+
+	var firstOutput string
+	for run := 0; run < 20; run++ {
+		m := New(options)
+		config, err := m.LoadConfig("dev")
+		h.AssertNoError(err)
+
+		var variables []string
+		for _, v := range config.Variables {
+			variables = append(variables, fmt.Sprintf("%s=%v", v.Name, v.Value))
+		}
+		if !reflect.DeepEqual(variables, expectedVariables) {
+			t.Fatalf("Run %d: expected variables %v, got %v", run, expectedVariables, variables)
+		}
+
+		var includes []string
+		for _, inc := range config.Include {
+			includes = append(includes, inc.File)
+		}
+		if !reflect.DeepEqual(includes, expectedIncludes) {
+			t.Fatalf("Run %d: expected includes %v, got %v", run, expectedIncludes, includes)
+		}
+
+		buildOutput := h.CaptureOutput(func() {
+			h.AssertNoError(m.Build())
+		})
+		if run == 0 {
+			firstOutput = buildOutput
+		} else if buildOutput != firstOutput {
+			t.Fatalf("Run %d: build output differs:\n%s\nvs:\n%s", run, firstOutput, buildOutput)
+		}
+	}
+}
+
+func TestVariableProvenance(t *testing.T) {
+	h := NewTestHelper(t)
+
+	basePath := h.CreateFile("config/base.yaml", `---
+variables:
+  - name: app_name
+    value: app
+  - name: tag
+    value: latest
+`)
+	overlayPath := h.CreateFile("config/overlays/tag.yaml", `---
+variables:
+  - name: tag
+    value: "1.0"
+`)
+	devPath := h.CreateFile("config/dev.yaml", `---
+resources:
+  - base.yaml
+  - overlays/
+variables:
+  - name: tag
+    value: "1.1"
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+	h.AssertNoError(err)
+	ApplyVariableOverrides(config, map[string]interface{}{"tag": "1.2", "extra": 1})
+
+	tag, found := config.FindVariable("tag")
+	if !found {
+		t.Fatal("Expected tag variable to be defined")
+	}
+
+	expected := []VariableOrigin{
+		{File: basePath, Line: 5, Value: "latest"},
+		{File: overlayPath, Line: 3, Value: "1.0"},
+		{File: devPath, Line: 6, Value: "1.1"},
+		{File: CommandLineOrigin, Value: "1.2"},
+	}
+	if !reflect.DeepEqual(tag.Origins, expected) {
+		t.Errorf("Expected origins %#v, got %#v", expected, tag.Origins)
+	}
+	if tag.Value != "1.2" {
+		t.Errorf("Expected tag to be '1.2', got %v", tag.Value)
+	}
+
+	appName, _ := config.FindVariable("app_name")
+	if len(appName.Origins) != 1 || appName.Origins[0].String() != basePath+":3" {
+		t.Errorf("Expected app_name to come from %s:3, got %v", basePath, appName.Origins)
+	}
+
+	extra, found := config.FindVariable("extra")
+	if !found || extra.Origins[0].String() != CommandLineOrigin {
+		t.Errorf("Expected extra to come from the command line, got %v", extra)
+	}
+}
+
+func TestDerivedVariablesFollowOverlays(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+variables:
+  - name: app_name
+    value: shop
+  - name: environment
+    value: base
+  - name: full_name
+    value: ${app_name}-${environment}
+include:
+  - file: configmap.yaml
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: service_name
+            value: ${full_name}-api
+`)
+	h.CreateFile("config/prod.yaml", `---
+resources:
+  - base.yaml
+variables:
+  - name: environment
+    value: prod
+`)
+	h.CreateFile("templates/configmap.yaml", "name: {{.full_name}}\n")
+	h.CreateFile("templates/service.yaml", "name: {{.service_name}}\n")
+
+	options := h.GetBuildOptions()
+	options.Environment = "prod"
+	options.Variables = map[string]interface{}{"app_name": "store"}
+	h.AssertNoError(New(options).Build())
+
+	h.AssertFileContains("output/configmap.yaml", "name: store-prod")
+	h.AssertFileContains("output/service-api.yaml", "name: store-prod-api")
+
+	h.CreateFile("config/cycle.yaml", `---
+resources:
+  - base.yaml
+variables:
+  - name: app_name
+    value: ${full_name}
+`)
+	options.Environment = "cycle"
+	options.Variables = nil
+	h.AssertErrorContains(New(options).Build(), "variable reference cycle: app_name -> full_name -> app_name")
+}
+
+func TestRepeatListsMergeByKey(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: port
+            value: 8080
+          - name: resources
+            value: { cpu: 100m, memory: 128Mi }
+      - key: web
+        values:
+          - name: port
+            value: 80
+      - key: debug
+        values:
+          - name: port
+            value: 9000
+`)
+	h.CreateFile("config/test.yaml", `---
+resources:
+  - base.yaml
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: resources
+            value: { memory: 512Mi }
+          - name: replicas
+            value: 3
+      - key: debug
+        $patch: delete
+      - key: web
+        $patch: replace
+        values:
+          - name: port
+            value: 443
+      - key: worker
+        values:
+          - name: port
+            value: 7000
+`)
+	h.CreateFile("templates/service.yaml", "port: {{ .port }}\n{{ with index . \"resources\" }}cpu: {{ .cpu }}\nmemory: {{ .memory }}\n{{ end }}{{ with index . \"replicas\" }}replicas: {{ . }}\n{{ end }}")
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "test", false)
+	h.AssertNoError(err)
+	if len(config.Include) != 1 {
+		t.Fatalf("Expected the overlay to extend the base include, got %d includes", len(config.Include))
+	}
+	var keys []string
+	for _, item := range config.Include[0].List {
+		keys = append(keys, item.Key)
+		if item.Patch != "" {
+			t.Errorf("Expected merge markers to be removed, got %q on %s", item.Patch, item.Key)
+		}
+	}
+	if expected := []string{"api", "web", "worker"}; !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected items %v, got %v", expected, keys)
+	}
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/service-api.yaml", "port: 8080\ncpu: 100m\nmemory: 512Mi\nreplicas: 3")
+	h.AssertFileContains("output/service-web.yaml", "port: 443")
+	h.AssertFileContains("output/service-worker.yaml", "port: 7000")
+	if h.FileExists("output/service-debug.yaml") {
+		t.Error("Expected the deleted item not to be built")
+	}
+}
+
+func TestRemovalsReachDoesNotDependOnResources(t *testing.T) {
+	shapes := map[string]string{
+		"without resources": "",
+		"with resources":    "resources:\n  - ../sub/c.yaml\n",
+	}
+
+	for name, resources := range shapes {
+		t.Run(name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/base/a.yaml", `---
+variables:
+  - name: debug_port
+    value: 9000
+include:
+  - file: a.yaml
+`)
+			h.CreateFile("config/base/b.yaml", "---\n"+resources+`exclude:
+  include:
+    - a.yaml
+variables:
+  - name: debug_port
+    $delete: true
+include:
+  - file: b.yaml
+`)
+			h.CreateFile("config/sub/c.yaml", "include:\n  - file: c.yaml\n")
+			h.CreateFile("config/dev.yaml", "resources:\n  - base/\n")
+
+			config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+			h.AssertNoError(err)
+
+			var files []string
+			for _, inc := range config.Include {
+				files = append(files, inc.File)
+			}
+			expected := []string{"b.yaml"}
+			if resources != "" {
+				expected = []string{"c.yaml", "b.yaml"}
+			}
+			if !reflect.DeepEqual(files, expected) {
+				t.Errorf("Expected includes %v, got %v", expected, files)
+			}
+			if _, found := config.FindVariable("debug_port"); found {
+				t.Error("Expected debug_port of the sibling a.yaml to be removed")
+			}
+		})
+	}
+}
+
+func TestOverlayRemovals(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+schemas:
+  - crds/legacy.yaml
+  - crds/current.yaml
+variables:
+  - name: app_name
+    value: store
+  - name: debug_port
+    value: 9000
+include:
+  - file: deployment.yaml
+  - file: debug/pod.yaml
+  - id: backup
+    file: cronjob.yaml
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: port
+            value: 80
+          - name: debug
+            value: true
+`)
+	h.CreateFile("config/prod.yaml", `---
+resources:
+  - base.yaml
+exclude:
+  include:
+    - debug/*
+    - backup
+  schemas:
+    - crds/legacy.yaml
+variables:
+  - name: debug_port
+    $delete: true
+  - name: missing
+    $delete: true
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: debug
+            $delete: true
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "prod", false)
+	h.AssertNoError(err)
+
+	if _, found := config.FindVariable("debug_port"); found {
+		t.Error("Expected debug_port to be removed")
+	}
+	if _, found := config.FindVariable("missing"); found {
+		t.Error("Expected $delete of an undefined variable to be ignored")
+	}
+	if !reflect.DeepEqual(config.Schemas, []string{"crds/current.yaml"}) {
+		t.Errorf("Expected only crds/current.yaml, got %v", config.Schemas)
+	}
+
+	var files []string
+	for _, inc := range config.Include {
+		files = append(files, inc.File)
+	}
+	if expected := []string{"deployment.yaml", "service.yaml"}; !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected includes %v, got %v", expected, files)
+	}
+	if values := config.Include[1].List[0].Values; len(values) != 1 || values[0].Name != "port" {
+		t.Errorf("Expected the debug value of api to be removed, got %v", values)
+	}
+
+	prodPath := filepath.Join(h.TempDir(), "config", "prod.yaml")
+	expected := []Removal{
+		{Kind: "variable", Name: "debug_port", Layer: prodPath},
+		{Kind: "schema", Name: "crds/legacy.yaml", Layer: prodPath},
+		{Kind: "include", Name: "debug/pod.yaml", Layer: prodPath},
+		{Kind: "include", Name: "backup", Layer: prodPath},
+	}
+	if !reflect.DeepEqual(config.Removed, expected) {
+		t.Errorf("Expected removals %v, got %v", expected, config.Removed)
+	}
+
+	// Without resources there is nothing to remove, the markers are dropped
+	h.CreateFile("config/solo.yaml", "variables:\n  - name: a\n    $delete: true\n  - name: b\n    value: 1\n")
+	config, err = LoadConfig(filepath.Join(h.TempDir(), "config"), "solo", false)
+	h.AssertNoError(err)
+	if len(config.Variables) != 1 || config.Variables[0].Name != "b" {
+		t.Errorf("Expected only b, got %v", config.Variables)
+	}
+
+	h.CreateFile("config/bad.yaml", "variables:\n  - name: a\n    value: 1\n    $delete: true\n")
+	_, err = LoadConfig(filepath.Join(h.TempDir(), "config"), "bad", false)
+	h.AssertErrorContains(err, "variable a cannot set a value and $delete")
+}
@@ -0,0 +1,698 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// ChildrenVariable is the variable holding the children of a repeat item
+const ChildrenVariable = "children"
+
+// Rendered reports whether an include is executed as a template, as opposed
+// to copied verbatim with render: false
+func (inc Include) Rendered() bool {
+	return inc.Render == nil || *inc.Render
+}
+
+// validateIncludes checks the include settings of a single config file. An
+// include with an id may leave out its file when it extends an include of
+// the resources.
+func validateIncludes(config *Config) error {
+	keys := make(map[string]bool)
+	for _, inc := range config.Include {
+		if inc.File == "" && inc.ID == "" {
+			return fmt.Errorf("include without a file")
+		}
+
+		key := getIncludeKey(inc)
+		if keys[key] {
+			if inc.ID != "" {
+				return fmt.Errorf("duplicate include id %q", inc.ID)
+			}
+			return fmt.Errorf("%s is included more than once, set a distinct id on each include of it", inc.File)
+		}
+		keys[key] = true
+
+		switch inc.Patch {
+		case "":
+		case "replace":
+			if inc.ID == "" {
+				return fmt.Errorf("%s: $patch can only be used on an include with an id", inc.Name())
+			}
+		default:
+			return fmt.Errorf("%s: unknown $patch %q (expected replace)", inc.Name(), inc.Patch)
+		}
+
+		if IsGlobPattern(inc.File) {
+			if _, err := path.Match(filepath.ToSlash(inc.File), ""); err != nil {
+				return fmt.Errorf("%s: invalid glob pattern: %w", inc.Name(), err)
+			}
+		} else if len(inc.Exclude) > 0 && inc.File != "" {
+			return fmt.Errorf("%s: exclude can only be used when file is a glob pattern", inc.Name())
+		}
+		for _, pattern := range inc.Exclude {
+			if _, err := path.Match(filepath.ToSlash(pattern), ""); err != nil {
+				return fmt.Errorf("%s: invalid exclude pattern %s: %w", inc.Name(), pattern, err)
+			}
+		}
+
+		switch inc.Repeat {
+		case "", "same-file", "multiple-files", "matrix":
+		default:
+			return fmt.Errorf("%s: unknown repeat type %q (expected same-file, multiple-files or matrix)", inc.Name(), inc.Repeat)
+		}
+
+		// An overlay with an id may inherit the matrix of a matrix include
+		if inc.Repeat == "matrix" && inc.Matrix == nil && inc.ID == "" {
+			return fmt.Errorf("%s: repeat: matrix requires a matrix section", inc.Name())
+		}
+		if inc.ListFrom != nil {
+			if inc.ListFrom.File == "" {
+				return fmt.Errorf("%s: listFrom without a file", inc.Name())
+			}
+			if inc.Repeat == "matrix" || (inc.Repeat == "" && inc.ID == "") {
+				return fmt.Errorf("%s: listFrom can only be used with repeat: same-file or multiple-files", inc.Name())
+			}
+		}
+		if inc.Matrix != nil {
+			if inc.Repeat != "matrix" && (inc.Repeat != "" || inc.ID == "") {
+				return fmt.Errorf("%s: matrix can only be used with repeat: matrix", inc.Name())
+			}
+			if len(inc.List) > 0 {
+				return fmt.Errorf("%s: matrix cannot be combined with list", inc.Name())
+			}
+			if err := inc.Matrix.validate(); err != nil {
+				return fmt.Errorf("%s: %w", inc.Name(), err)
+			}
+		}
+
+		if !inc.Rendered() {
+			if inc.Repeat != "" {
+				return fmt.Errorf("%s: render: false cannot be combined with repeat", inc.Name())
+			}
+			if len(inc.Delims) > 0 {
+				return fmt.Errorf("%s: render: false cannot be combined with delims", inc.Name())
+			}
+		}
+
+		if len(inc.Delims) > 0 {
+			if len(inc.Delims) != 2 || inc.Delims[0] == "" || inc.Delims[1] == "" {
+				return fmt.Errorf("%s: delims must be a left and a right delimiter, e.g. [\"[[\", \"]]\"]", inc.Name())
+			}
+		}
+
+		if inc.When != "" {
+			if _, err := parseWhen(inc.When); err != nil {
+				return fmt.Errorf("%s: invalid when condition: %w", inc.Name(), err)
+			}
+		}
+		if err := validateListItems(inc.Name(), inc.List); err != nil {
+			return err
+		}
+
+		switch inc.ChildRepeat {
+		case "":
+		case "same-file":
+			// An overlay with an id may set the childRepeat of an inherited repeat
+			if inc.Repeat != "multiple-files" && (inc.Repeat != "" || inc.ID == "") {
+				return fmt.Errorf("%s: childRepeat: same-file requires repeat: multiple-files", inc.Name())
+			}
+		default:
+			return fmt.Errorf("%s: unknown childRepeat %q (expected same-file)", inc.Name(), inc.ChildRepeat)
+		}
+
+		if len(inc.Variables) > 0 && inc.Repeat != "" {
+			return fmt.Errorf("%s: variables cannot be combined with repeat, set them in the values of each list item", inc.Name())
+		}
+		for _, v := range inc.Variables {
+			if v.Name == "" {
+				return fmt.Errorf("%s: variable without a name", inc.Name())
+			}
+		}
+
+		if inc.Output != "" {
+			if _, err := template.New("output").Funcs(TemplateFuncMap()).Parse(inc.Output); err != nil {
+				return fmt.Errorf("%s: invalid output path template: %w", inc.Name(), err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateListItems checks the keys, $patch markers and when conditions of
+// repeat items and, nested under name[key], of their children
+func validateListItems(name string, items []ListItem) error {
+	keys := make(map[string]bool)
+	for _, item := range items {
+		if keys[item.Key] {
+			return fmt.Errorf("%s: duplicate list key %q", name, item.Key)
+		}
+		keys[item.Key] = true
+
+		itemName := fmt.Sprintf("%s[%s]", name, item.Key)
+		switch item.Patch {
+		case "", "delete", "replace":
+		default:
+			return fmt.Errorf("%s: unknown $patch %q (expected delete or replace)", itemName, item.Patch)
+		}
+		if item.When != "" {
+			if _, err := parseWhen(item.When); err != nil {
+				return fmt.Errorf("%s: invalid when condition: %w", itemName, err)
+			}
+		}
+		if err := validateListItems(itemName, item.Children); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateMergedIncludes checks the includes of an environment once every
+// layer is merged, when overlays have been applied to the includes they extend
+func validateMergedIncludes(config *Config) error {
+	for _, inc := range config.Include {
+		if inc.File == "" {
+			return fmt.Errorf("include %s has no file and extends no include of the resources", inc.ID)
+		}
+		if inc.Repeat == "matrix" && inc.Matrix == nil {
+			return fmt.Errorf("%s: repeat: matrix requires a matrix section", inc.Name())
+		}
+		if inc.Matrix != nil && inc.Repeat != "matrix" {
+			return fmt.Errorf("%s: matrix can only be used with repeat: matrix", inc.Name())
+		}
+		if inc.ListFrom != nil && inc.Repeat != "same-file" && inc.Repeat != "multiple-files" {
+			return fmt.Errorf("%s: listFrom can only be used with repeat: same-file or multiple-files", inc.Name())
+		}
+		if inc.ChildRepeat != "" && inc.Repeat != "multiple-files" {
+			return fmt.Errorf("%s: childRepeat: same-file requires repeat: multiple-files", inc.Name())
+		}
+	}
+	if err := validateIncludes(config); err != nil {
+		return err
+	}
+
+	// A repeat without items would build nothing without telling anyone
+	for _, inc := range config.Include {
+		if (inc.Repeat == "same-file" || inc.Repeat == "multiple-files") && len(inc.List) == 0 {
+			return fmt.Errorf("%s: repeat: %s has no list items", inc.Name(), inc.Repeat)
+		}
+	}
+	return nil
+}
+
+// Name identifies an include in messages: its id, or else its file
+func (inc Include) Name() string {
+	if inc.ID != "" {
+		return inc.ID
+	}
+	return inc.File
+}
+
+// mergeInclude applies an overlay to the include with the same id. The
+// fields the overlay sets replace the inherited ones, its variables are
+// merged by name and its list item by item; with $patch: replace the overlay
+// replaces the include.
+func mergeInclude(base, overlay Include, opts MergeOptions) Include {
+	if overlay.Patch == "replace" {
+		overlay.Patch = ""
+		overlay.List = mergeListItems(nil, overlay.List, opts)
+		return overlay
+	}
+
+	result := base
+	if overlay.File != "" {
+		result.File = overlay.File
+	}
+	if len(overlay.Exclude) > 0 {
+		result.Exclude = overlay.Exclude
+	}
+	if overlay.Repeat != "" {
+		result.Repeat = overlay.Repeat
+	}
+	result.List = mergeListItems(base.List, overlay.List, opts)
+	if overlay.Render != nil {
+		result.Render = overlay.Render
+	}
+	if overlay.Matrix != nil {
+		result.Matrix = overlay.Matrix
+	}
+	if overlay.ListFrom != nil {
+		result.ListFrom = overlay.ListFrom
+	}
+	if len(overlay.Delims) > 0 {
+		result.Delims = overlay.Delims
+	}
+	if overlay.Output != "" {
+		result.Output = overlay.Output
+	}
+	if overlay.When != "" {
+		result.When = overlay.When
+	}
+	if overlay.ChildRepeat != "" {
+		result.ChildRepeat = overlay.ChildRepeat
+	}
+
+	result.Variables = mergeItemValues(base.Variables, overlay.Variables, opts)
+	return result
+}
+
+// mergeListItems merges the repeat items of an overlay into the inherited
+// ones by key: the values of an existing item are merged by name, new items
+// are appended and items marked with $patch: delete are removed. Inherited
+// items keep their position. Children are merged the same way.
+func mergeListItems(base, overlay []ListItem, opts MergeOptions) []ListItem {
+	if base == nil && overlay == nil {
+		return nil
+	}
+
+	result := make([]ListItem, 0, len(base)+len(overlay))
+	index := make(map[string]int)
+	for _, item := range base {
+		index[item.Key] = len(result)
+		result = append(result, item)
+	}
+
+	deleted := make(map[string]bool)
+	for _, item := range overlay {
+		i, exists := index[item.Key]
+		switch {
+		case item.Patch == "delete":
+			deleted[item.Key] = true
+			continue
+		case !exists:
+			item.Patch = ""
+			item.Values = mergeItemValues(nil, item.Values, opts)
+			item.Children = mergeListItems(nil, item.Children, opts)
+			index[item.Key] = len(result)
+			result = append(result, item)
+		case item.Patch == "replace":
+			item.Patch = ""
+			item.Values = mergeItemValues(nil, item.Values, opts)
+			item.Children = mergeListItems(nil, item.Children, opts)
+			result[i] = item
+		default:
+			result[i].Values = mergeItemValues(result[i].Values, item.Values, opts)
+			result[i].Children = mergeListItems(result[i].Children, item.Children, opts)
+			if item.When != "" {
+				result[i].When = item.When
+			}
+		}
+		delete(deleted, item.Key)
+	}
+
+	if len(deleted) == 0 {
+		return result
+	}
+	kept := result[:0]
+	for _, item := range result {
+		if !deleted[item.Key] {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// mergeItemValues merges values by name like global variables: map values
+// are deep merged, new values are appended and $delete removes a value
+func mergeItemValues(base, overlay []Variable, opts MergeOptions) []Variable {
+	if base == nil && overlay == nil {
+		return nil
+	}
+
+	result := append([]Variable{}, base...)
+	index := make(map[string]int)
+	for i, v := range result {
+		index[v.Name] = i
+	}
+	deleted := make(map[string]bool)
+	for _, v := range overlay {
+		if v.Delete {
+			deleted[v.Name] = true
+			continue
+		}
+		if i, exists := index[v.Name]; exists {
+			result[i].Value = mergeValues(result[i].Value, v.Value, opts)
+			result[i].ValueFrom = v.ValueFrom
+			result[i].Sensitive = result[i].Sensitive || v.Sensitive
+			continue
+		}
+		v.Value = mergeValues(nil, v.Value, opts)
+		index[v.Name] = len(result)
+		result = append(result, v)
+	}
+
+	if len(deleted) == 0 {
+		return result
+	}
+	kept := result[:0]
+	for _, v := range result {
+		if !deleted[v.Name] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
+// IsGlobPattern reports whether an include file is a glob pattern
+func IsGlobPattern(file string) bool {
+	return strings.ContainsAny(file, "*?[")
+}
+
+// ExpandIncludes replaces every include whose file is a glob pattern with one
+// include per matching template, sorted by path. Helper files, the given
+// partials (see LoadPartials) and files matching an exclude pattern are
+// skipped. A file listed explicitly, or matched by an earlier pattern, is not
+// added again.
+func (m *MikoManifest) ExpandIncludes(includes []Include, partials ...string) ([]Include, error) {
+	isPartial := make(map[string]bool, len(partials))
+	for _, p := range partials {
+		isPartial[p] = true
+	}
+
+	listed := make(map[string]bool)
+	hasPatterns := false
+	for _, inc := range includes {
+		if IsGlobPattern(inc.File) {
+			hasPatterns = true
+		} else {
+			listed[outputBaseName(inc.File)] = true
+		}
+	}
+	if !hasPatterns {
+		return includes, nil
+	}
+
+	templates, err := m.listTemplateFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	expanded := make([]Include, 0, len(includes))
+	for _, inc := range includes {
+		if !IsGlobPattern(inc.File) {
+			expanded = append(expanded, inc)
+			continue
+		}
+
+		pattern := filepath.ToSlash(filepath.Clean(inc.File))
+		matched, excluded := 0, 0
+		for _, file := range templates {
+			if !matchGlob(pattern, file) || IsHelperFile(file) || isPartial[file] {
+				continue
+			}
+			matched++
+			if matchesAny(inc.Exclude, file) {
+				excluded++
+				continue
+			}
+			if listed[file] {
+				continue
+			}
+			listed[file] = true
+
+			match := inc
+			match.File = file
+			match.Exclude = nil
+			expanded = append(expanded, match)
+		}
+
+		if matched == 0 {
+			return nil, fmt.Errorf("include pattern %s matched no template files in %s", inc.File, m.options.TemplatesDir)
+		}
+		if excluded == matched {
+			return nil, fmt.Errorf("include pattern %s: all %d matching template file(s) are excluded", inc.File, matched)
+		}
+	}
+	return expanded, nil
+}
+
+// listTemplateFiles returns every file of the templates directory as a
+// sorted slash separated path relative to it
+func (m *MikoManifest) listTemplateFiles() ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(m.options.TemplatesDir, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(m.options.TemplatesDir, file)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list templates in %s: %w", m.options.TemplatesDir, err)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// matchesAny reports whether a slash separated path matches one of the patterns
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matchGlob(filepath.ToSlash(filepath.Clean(pattern)), name) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchGlob matches a slash separated path against a pattern where "**"
+// matches any number of directories and other segments follow path.Match
+func matchGlob(pattern, name string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// "**" as the last segment matches everything below
+			if len(pattern) == 1 {
+				return len(name) > 0
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// outputBaseName is the default output file of an include: the template
+// path, keeping its subdirectories. Templates outside the templates
+// directory are written at the top of the output directory.
+func outputBaseName(file string) string {
+	name := filepath.ToSlash(filepath.Clean(file))
+	if filepath.IsAbs(file) || name == ".." || strings.HasPrefix(name, "../") {
+		return path.Base(name)
+	}
+	return name
+}
+
+// repeatOutputName is the output file of a multiple-files repeat item:
+// "api/service.yaml" with key "web" becomes "api/service-web.yaml"
+func repeatOutputName(name, key string) string {
+	ext := path.Ext(name)
+	return fmt.Sprintf("%s-%s%s", strings.TrimSuffix(name, ext), key, ext)
+}
+
+// outputName returns the output file of an include, or of one of its repeat
+// items, relative to the output directory. Without an output template the
+// template name is used, suffixed with the item key for repeat items. The
+// output template sees the same variables as the template, and .key for
+// repeat items.
+func (inc *Include) outputName(name string, item *ListItem, variables map[string]interface{}) (string, error) {
+	if inc == nil || inc.Output == "" {
+		if item != nil {
+			return repeatOutputName(name, item.Key), nil
+		}
+		return name, nil
+	}
+
+	data := make(map[string]interface{}, len(variables)+1)
+	for k, v := range variables {
+		data[k] = v
+	}
+	source := name
+	if item != nil {
+		data["key"] = item.Key
+		source = fmt.Sprintf("%s[%s]", name, item.Key)
+	}
+
+	tmpl, err := template.New("output").Funcs(TemplateFuncMap()).Option("missingkey=error").Parse(inc.Output)
+	if err != nil {
+		return "", fmt.Errorf("invalid output path of %s: %w", source, err)
+	}
+	var result strings.Builder
+	if err := tmpl.Execute(&result, data); err != nil {
+		return "", fmt.Errorf("failed to render output path of %s: %w", source, err)
+	}
+
+	output := path.Clean(strings.TrimSpace(result.String()))
+	if output == "." || output == "/" || strings.HasSuffix(result.String(), "/") {
+		return "", fmt.Errorf("output path of %s is %q, expected a file name", source, result.String())
+	}
+	if path.IsAbs(output) || output == ".." || strings.HasPrefix(output, "../") {
+		return "", fmt.Errorf("output path of %s must stay inside the output directory, got %s", source, output)
+	}
+	return output, nil
+}
+
+// itemVariables merges the values of a repeat item over the global variables
+// and resolves their references. The children of the item are set as
+// ChildrenVariable, an empty list for an item without children.
+func itemVariables(globalVars map[string]interface{}, item ListItem) (map[string]interface{}, error) {
+	variables := parentValues(globalVars, item)
+	variables[ChildrenVariable] = childValues(item.Children)
+	return ResolveVariableReferences(variables)
+}
+
+// parentValues merges the values of a repeat item over the global variables
+// without resolving their references, for the children of the item: they
+// are resolved once, together with the child values, by itemVariables
+func parentValues(globalVars map[string]interface{}, item ListItem) map[string]interface{} {
+	variables := make(map[string]interface{}, len(globalVars)+len(item.Values)+1)
+	for k, v := range globalVars {
+		variables[k] = v
+	}
+	for _, v := range item.Values {
+		variables[v.Name] = v.Value
+	}
+	return variables
+}
+
+// childValues turns nested items into a list of maps the templates can range
+// over: each map holds the key and values of a child, and its own children
+// (possibly none)
+func childValues(children []ListItem) []interface{} {
+	values := make([]interface{}, 0, len(children))
+	for _, child := range children {
+		value := make(map[string]interface{}, len(child.Values)+2)
+		for _, v := range child.Values {
+			value[v.Name] = v.Value
+		}
+		value["key"] = child.Key
+		value[ChildrenVariable] = childValues(child.Children)
+		values = append(values, value)
+	}
+	return values
+}
+
+// childSections returns the children of an item as rendered by childRepeat:
+// like in .children, each child sees its key as .key
+func childSections(children []ListItem) []ListItem {
+	sections := make([]ListItem, len(children))
+	for i, child := range children {
+		child.Values = append([]Variable{{Name: "key", Value: child.Key}}, child.Values...)
+		sections[i] = child
+	}
+	return sections
+}
+
+// walkListItems calls fn for every item of a list and, depth first, for
+// their children
+func walkListItems(items []ListItem, fn func(ListItem) error) error {
+	for _, item := range items {
+		if err := fn(item); err != nil {
+			return err
+		}
+		if err := walkListItems(item.Children, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkOutputCollisions fails if two includes, or two items of a repeat,
+// would write the same output file
+func (m *MikoManifest) checkOutputCollisions(includes []Include, globalVars []Variable) error {
+	merged := m.MergeVariables(globalVars, nil, m.options.Variables)
+
+	writers := make(map[string]string)
+	add := func(file, writer string) error {
+		if previous, exists := writers[file]; exists {
+			return fmt.Errorf("output file %s would be written by both %s and %s", file, previous, writer)
+		}
+		writers[file] = writer
+		return nil
+	}
+
+	for i := range includes {
+		inc := &includes[i]
+		name := outputBaseName(inc.File)
+
+		if inc.Repeat != "multiple-files" || !inc.Rendered() {
+			variables, err := ResolveVariableReferences(m.MergeVariables(globalVars, inc.Variables, m.options.Variables))
+			if err != nil {
+				return fmt.Errorf("failed to resolve variables for %s: %w", inc.File, err)
+			}
+			file, err := inc.outputName(name, nil, variables)
+			if err != nil {
+				return err
+			}
+			if err := add(file, inc.File); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, item := range inc.List {
+			itemVars, err := itemVariables(merged, item)
+			if err != nil {
+				return fmt.Errorf("failed to resolve variables for %s[%s]: %w", inc.File, item.Key, err)
+			}
+			file, err := inc.outputName(name, &item, itemVars)
+			if err != nil {
+				return err
+			}
+			if err := add(file, fmt.Sprintf("%s[%s]", inc.File, item.Key)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// templateName returns the path of a template relative to the templates
+// directory, which names it in messages and places its output
+func (m *MikoManifest) templateName(templatePath string) string {
+	if m.options.TemplatesDir != "" {
+		rel, err := filepath.Rel(m.options.TemplatesDir, templatePath)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.ToSlash(rel)
+		}
+	}
+	return filepath.Base(templatePath)
+}
+
+// writeOutputFile writes a rendered file, creating its subdirectories
+func writeOutputFile(outputDir, name string, content []byte) error {
+	outputFile := filepath.Join(outputDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(outputFile), 0755); err != nil {
+		return fmt.Errorf("failed to create output directory %s: %w", filepath.Dir(outputFile), err)
+	}
+	if err := os.WriteFile(outputFile, content, 0644); err != nil {
+		return fmt.Errorf("failed to write output file %s: %w", outputFile, err)
+	}
+	return nil
+}
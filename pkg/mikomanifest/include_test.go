@@ -0,0 +1,537 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRawAndDelimsIncludes(t *testing.T) {
+	h := NewTestHelper(t)
+
+	rules := `groups:
+  - name: node
+    rules:
+      - alert: InstanceDown
+        annotations:
+          summary: "{{ $labels.instance }} is down"
+`
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: app_name
+    value: my-app
+include:
+  - file: rules.yaml
+    render: false
+  - file: dashboard.yaml
+    delims: ["[[", "]]"]
+  - file: alerts.yaml
+    repeat: multiple-files
+    delims: ["[[", "]]"]
+    list:
+      - key: api
+        values:
+          - name: threshold
+            value: 5
+`)
+	h.CreateFile("templates/rules.yaml", rules)
+	h.CreateFile("templates/dashboard.yaml", "title: [[ .app_name | upper ]]\nlegend: \"{{ instance }}\"\n")
+	h.CreateFile("templates/alerts.yaml", "expr: errors > [[ .threshold ]]\nsummary: \"{{ $value }}\"\n")
+
+	out := h.CaptureOutput(func() {
+		h.AssertNoError(New(h.GetBuildOptions()).Build())
+	})
+
+	if got := h.ReadFile("output/rules.yaml"); got != rules {
+		t.Errorf("Expected raw file to be copied verbatim, got:\n%s", got)
+	}
+	h.AssertStringContains(out, "PROCESSED: rules.yaml -> rules.yaml (raw)")
+	h.AssertFileContains("output/dashboard.yaml", "title: MY-APP\nlegend: \"{{ instance }}\"")
+	h.AssertFileContains("output/alerts-api.yaml", "expr: errors > 5\nsummary: \"{{ $value }}\"")
+}
+
+func TestIncludeVariables(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: app_name
+    value: my-app
+  - name: replicas
+    value: 1
+  - name: image
+    value: app:${tag}
+  - name: tag
+    value: latest
+include:
+  - id: web
+    file: deployment.yaml
+  - id: worker
+    file: deployment.yaml
+    output: worker.yaml
+    variables:
+      - name: app_name
+        value: ${base}-worker
+      - name: base
+        value: my-app
+      - name: replicas
+        value: 3
+      - name: tag
+        value: "2.0"
+`)
+	h.CreateFile("templates/deployment.yaml", "name: {{ .app_name }}\nreplicas: {{ .replicas }}\nimage: {{ .image }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/deployment.yaml", "name: my-app\nreplicas: 1\nimage: app:latest")
+	h.AssertFileContains("output/worker.yaml", "name: my-app-worker\nreplicas: 3\nimage: app:2.0")
+
+	// Command line overrides win over include variables
+	options := h.GetBuildOptions()
+	options.Variables = map[string]interface{}{"replicas": 5}
+	h.AssertNoError(New(options).Build())
+	h.AssertFileContains("output/deployment.yaml", "replicas: 5")
+	h.AssertFileContains("output/worker.yaml", "replicas: 5")
+}
+
+func TestIncludeIdentity(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+include:
+  - id: backup
+    file: cronjob.yaml
+    output: backup.yaml
+    variables:
+      - name: schedule
+        value: "0 2 * * *"
+      - name: command
+        value: backup
+  - id: cleanup
+    file: cronjob.yaml
+    output: cleanup.yaml
+    when: "true"
+    variables:
+      - name: schedule
+        value: "0 3 * * *"
+  - id: workers
+    file: worker.yaml
+    repeat: multiple-files
+    list:
+      - key: a
+        values: []
+`)
+	h.CreateFile("config/test.yaml", `---
+resources:
+  - base.yaml
+include:
+  - id: backup
+    variables:
+      - name: schedule
+        value: "0 4 * * *"
+  - id: cleanup
+    $patch: replace
+    file: cronjob.yaml
+    output: cleanup.yaml
+    variables:
+      - name: schedule
+        value: "0 5 * * *"
+  - id: workers
+    list:
+      - key: b
+        values: []
+  - id: audit
+    file: cronjob.yaml
+    output: audit.yaml
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "test", false)
+	h.AssertNoError(err)
+
+	var ids []string
+	for _, inc := range config.Include {
+		ids = append(ids, inc.ID)
+	}
+	if expected := []string{"backup", "cleanup", "workers", "audit"}; !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("Expected includes %v, got %v", expected, ids)
+	}
+
+	backup := config.Include[0]
+	if backup.File != "cronjob.yaml" || backup.Output != "backup.yaml" || len(backup.Variables) != 2 ||
+		backup.Variables[0].Value != "0 4 * * *" || backup.Variables[1].Value != "backup" {
+		t.Errorf("Expected backup to be extended, got %+v", backup)
+	}
+	cleanup := config.Include[1]
+	if cleanup.When != "" || cleanup.Patch != "" || len(cleanup.Variables) != 1 || cleanup.Variables[0].Value != "0 5 * * *" {
+		t.Errorf("Expected cleanup to be replaced, got %+v", cleanup)
+	}
+	workers := config.Include[2]
+	if workers.File != "worker.yaml" || workers.Repeat != "multiple-files" || len(workers.List) != 2 || workers.List[1].Key != "b" {
+		t.Errorf("Expected workers to keep its file and gain item b, got %+v", workers)
+	}
+}
+
+func TestIncludeIdentityErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			name:     "duplicate id",
+			files:    map[string]string{"dev.yaml": "include:\n  - id: job\n    file: a.yaml\n  - id: job\n    file: b.yaml\n"},
+			expected: "duplicate include id \"job\"",
+		},
+		{
+			name:     "same file twice without id",
+			files:    map[string]string{"dev.yaml": "include:\n  - file: a.yaml\n  - file: a.yaml\n    output: b.yaml\n"},
+			expected: "a.yaml is included more than once",
+		},
+		{
+			name:     "same repeat twice without id",
+			files:    map[string]string{"dev.yaml": "include:\n  - file: a.yaml\n    repeat: multiple-files\n    list: [{key: x}]\n  - file: a.yaml\n    repeat: multiple-files\n    list: [{key: y}]\n"},
+			expected: "a.yaml is included more than once, set a distinct id on each include of it",
+		},
+		{
+			name:     "id without a base include",
+			files:    map[string]string{"dev.yaml": "include:\n  - id: job\n    when: \"true\"\n"},
+			expected: "include job has no file and extends no include of the resources",
+		},
+		{
+			name:     "patch without id",
+			files:    map[string]string{"dev.yaml": "include:\n  - file: a.yaml\n    $patch: replace\n"},
+			expected: "a.yaml: $patch can only be used on an include with an id",
+		},
+		{
+			name:     "unknown patch",
+			files:    map[string]string{"dev.yaml": "include:\n  - id: job\n    file: a.yaml\n    $patch: merge\n"},
+			expected: "job: unknown $patch \"merge\"",
+		},
+		{
+			name: "invalid once merged",
+			files: map[string]string{
+				"base.yaml": "include:\n  - id: job\n    file: a.yaml\n    render: false\n",
+				"dev.yaml":  "resources:\n  - base.yaml\ninclude:\n  - id: job\n    repeat: same-file\n",
+			},
+			expected: "job: render: false cannot be combined with repeat",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			for name, content := range tt.files {
+				h.CreateFile("config/"+name, content)
+			}
+			_, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+			h.AssertErrorContains(err, tt.expected)
+		})
+	}
+}
+
+func TestCheckReportsDuplicateIncludeIDs(t *testing.T) {
+	h := NewTestHelper(t)
+	h.CreateFile("config/dev.yaml", "include:\n  - id: job\n    file: a.yaml\n  - id: job\n    file: b.yaml\n")
+
+	var err error
+	out := h.CaptureOutput(func() {
+		err = CheckConfigDirectory(CheckOptions{ConfigDir: filepath.Join(h.TempDir(), "config")})
+	})
+	h.AssertErrorContains(err, "environment configuration validation failed")
+	h.AssertStringContains(out, "duplicate include id \"job\"")
+}
+
+func TestValidateIncludes(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr string
+	}{
+		{"unknown repeat", "include:\n  - file: a.yaml\n    repeat: twice\n", "unknown repeat type"},
+		{"raw with repeat", "include:\n  - file: a.yaml\n    render: false\n    repeat: same-file\n", "cannot be combined with repeat"},
+		{"raw with delims", "include:\n  - file: a.yaml\n    render: false\n    delims: ['[[', ']]']\n", "cannot be combined with delims"},
+		{"one delimiter", "include:\n  - file: a.yaml\n    delims: ['[[']\n", "delims must be a left and a right delimiter"},
+		{"empty delimiter", "include:\n  - file: a.yaml\n    delims: ['[[', '']\n", "delims must be a left and a right delimiter"},
+		{"variables with repeat", "include:\n  - file: a.yaml\n    repeat: same-file\n    variables:\n      - name: x\n        value: 1\n", "variables cannot be combined with repeat"},
+		{"unknown item patch", "include:\n  - file: a.yaml\n    repeat: same-file\n    list:\n      - key: x\n        $patch: remove\n", "a.yaml[x]: unknown $patch \"remove\""},
+		{"variable without a name", "include:\n  - file: a.yaml\n    variables:\n      - value: 1\n", "variable without a name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			var config Config
+			h.AssertNoError(yaml.Unmarshal([]byte(tt.content), &config))
+			h.AssertErrorContains(validateIncludes(&config), tt.wantErr)
+		})
+	}
+
+	var config Config
+	if err := yaml.Unmarshal([]byte("include:\n  - file: a.yaml\n    render: true\n    delims: ['<<', '>>']\n"), &config); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if err := validateIncludes(&config); err != nil {
+		t.Errorf("Expected valid includes, got: %v", err)
+	}
+}
+
+func TestBuildPreservesTemplateDirectories(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+include:
+  - file: api/service.yaml
+  - file: monitoring/service.yaml
+  - file: monitoring/rules/alerts.yaml
+    render: false
+  - file: api/deployment.yaml
+    repeat: multiple-files
+    list:
+      - key: blue
+        values: []
+      - key: green
+        values: []
+`)
+	service := "apiVersion: v1\nkind: Service\nmetadata:\n  name: %s\nspec:\n  ports:\n    - port: 80\n"
+	h.CreateFile("templates/api/service.yaml", fmt.Sprintf(service, "api"))
+	h.CreateFile("templates/monitoring/service.yaml", fmt.Sprintf(service, "monitoring"))
+	h.CreateFile("templates/monitoring/rules/alerts.yaml", "summary: \"{{ $labels.instance }}\"\n")
+	h.CreateFile("templates/api/deployment.yaml", "name: api-{{ .app }}\n")
+
+	options := h.GetBuildOptions()
+	options.Variables = map[string]interface{}{"app": "x"}
+	out := h.CaptureOutput(func() {
+		h.AssertNoError(New(options).Build())
+	})
+
+	h.AssertFileContains("output/api/service.yaml", "name: api")
+	h.AssertFileContains("output/monitoring/service.yaml", "name: monitoring")
+	h.AssertFileContains("output/monitoring/rules/alerts.yaml", "{{ $labels.instance }}")
+	h.AssertFileContains("output/api/deployment-blue.yaml", "name: api-x")
+	h.AssertFileContains("output/api/deployment-green.yaml", "name: api-x")
+	h.AssertStringContains(out, "PROCESSED: api/deployment.yaml -> api/deployment-green.yaml (multi-file)")
+	if h.FileExists("output/service.yaml") {
+		t.Error("Expected no flattened output file")
+	}
+
+	// validate walks the whole output tree
+	h.CreateFile("output/monitoring/broken.yaml", "apiVersion: v1\nkind: Service\nspec:\n  ports: 80\n")
+	var lintErr error
+	out = h.CaptureOutput(func() {
+		lintErr = LintDirectory(h.GetLintOptions())
+	})
+	h.AssertError(lintErr)
+	h.AssertStringContains(out, "VALID: monitoring/service.yaml")
+	h.AssertStringContains(out, "ERROR: monitoring/broken.yaml")
+}
+
+func TestBuildFailsOnOutputCollisions(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		wantErr string
+	}{
+		{
+			name:    "same output across includes",
+			include: "  - file: app-web.yaml\n  - file: app.yaml\n    repeat: multiple-files\n    list:\n      - key: web\n        values: []\n",
+			wantErr: "output file app-web.yaml would be written by both app-web.yaml and app.yaml[web]",
+		},
+		{
+			name:    "duplicate repeat keys",
+			include: "  - file: app.yaml\n    repeat: multiple-files\n    list:\n      - key: web\n        values: []\n      - key: web\n        values: []\n",
+			wantErr: "app.yaml: duplicate list key \"web\"",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "include:\n"+tt.include)
+			h.CreateFile("templates/app.yaml", "a: 1\n")
+			h.CreateFile("templates/app-web.yaml", "a: 2\n")
+
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.wantErr)
+			if h.FileExists("output/app-web.yaml") {
+				t.Error("Expected nothing to be written")
+			}
+		})
+	}
+}
+
+func TestIncludeOutputPaths(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: env
+    value: prod
+  - name: namespace
+    value: apps
+include:
+  - file: deployment.yaml
+    output: "{{ .env }}/{{ .namespace }}/deployment.yaml"
+  - file: service.yaml
+    repeat: multiple-files
+    output: "{{ .namespace }}/svc-{{ .key }}.yaml"
+    list:
+      - key: api
+        values: []
+      - key: web
+        values:
+          - name: namespace
+            value: frontend
+  - file: configmap.yaml
+    repeat: same-file
+    output: "{{ .env }}/configmaps.yaml"
+    list:
+      - key: a
+        values: []
+  - file: rules.yaml
+    render: false
+    output: "monitoring/{{ .env | upper }}-rules.yaml"
+`)
+	h.CreateFile("templates/deployment.yaml", "kind: Deployment\n")
+	h.CreateFile("templates/service.yaml", "namespace: {{ .namespace }}\n")
+	h.CreateFile("templates/configmap.yaml", "kind: ConfigMap\n")
+	h.CreateFile("templates/rules.yaml", "expr: \"{{ $value }}\"\n")
+
+	out := h.CaptureOutput(func() {
+		h.AssertNoError(New(h.GetBuildOptions()).Build())
+	})
+
+	h.AssertFileContains("output/prod/apps/deployment.yaml", "kind: Deployment")
+	h.AssertFileContains("output/apps/svc-api.yaml", "namespace: apps")
+	h.AssertFileContains("output/frontend/svc-web.yaml", "namespace: frontend")
+	h.AssertFileContains("output/prod/configmaps.yaml", "kind: ConfigMap")
+	h.AssertFileContains("output/monitoring/PROD-rules.yaml", "{{ $value }}")
+	h.AssertStringContains(out, "PROCESSED: service.yaml -> frontend/svc-web.yaml (multi-file)")
+	if h.FileExists("output/deployment.yaml") || h.FileExists("output/service-api.yaml") {
+		t.Error("Expected default output names not to be used")
+	}
+}
+
+func TestIncludeOutputPathErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		wantErr string
+	}{
+		{"missing variable", "  - file: app.yaml\n    output: '{{ .region }}/app.yaml'\n", `map has no entry for key "region"`},
+		{"outside output directory", "  - file: app.yaml\n    output: '../{{ .env }}.yaml'\n", "must stay inside the output directory"},
+		{"absolute path", "  - file: app.yaml\n    output: /tmp/app.yaml\n", "must stay inside the output directory"},
+		{"directory", "  - file: app.yaml\n    output: '{{ .env }}/'\n", "expected a file name"},
+		{"invalid template", "  - file: app.yaml\n    output: '{{ .env'\n", "invalid output path template"},
+		{
+			"same output for every item",
+			"  - file: app.yaml\n    repeat: multiple-files\n    output: '{{ .env }}.yaml'\n    list:\n      - key: a\n        values: []\n      - key: b\n        values: []\n",
+			"output file prod.yaml would be written by both app.yaml[a] and app.yaml[b]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "variables:\n  - name: env\n    value: prod\ninclude:\n"+tt.include)
+			h.CreateFile("templates/app.yaml", "a: 1\n")
+
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.wantErr)
+		})
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		name     string
+		expected bool
+	}{
+		{"monitoring/*.yaml", "monitoring/rules.yaml", true},
+		{"monitoring/*.yaml", "monitoring/alerts/rules.yaml", false},
+		{"base/**", "base/app.yaml", true},
+		{"base/**", "base/a/b/app.yaml", true},
+		{"base/**", "base", false},
+		{"**/service.yaml", "service.yaml", true},
+		{"**/service.yaml", "api/v1/service.yaml", true},
+		{"base/**/*.yml", "base/x/app.yaml", false},
+		{"*.yaml", "api/app.yaml", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.expected {
+			t.Errorf("matchGlob(%s, %s): expected %v, got %v", tt.pattern, tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestGlobIncludes(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+include:
+  - file: monitoring/*.yaml
+    exclude:
+      - monitoring/*-test.yaml
+  - file: base/**
+  - file: base/special.yaml
+    repeat: multiple-files
+    list:
+      - key: a
+        values: []
+`)
+	for _, file := range []string{
+		"monitoring/b.yaml", "monitoring/a.yaml", "monitoring/c-test.yaml", "monitoring/nested/d.yaml",
+		"base/app.yaml", "base/special.yaml", "base/net/policy.yaml", "base/_helpers.tpl",
+	} {
+		h.CreateFile("templates/"+file, "file: "+file+"\n")
+	}
+
+	m := New(h.GetBuildOptions())
+	config, err := m.LoadConfig("test")
+	h.AssertNoError(err)
+	includes, err := m.ExpandIncludes(config.Include)
+	h.AssertNoError(err)
+
+	var files []string
+	for _, inc := range includes {
+		files = append(files, inc.File)
+	}
+	expected := []string{"monitoring/a.yaml", "monitoring/b.yaml", "base/app.yaml", "base/net/policy.yaml", "base/special.yaml"}
+	if fmt.Sprint(files) != fmt.Sprint(expected) {
+		t.Errorf("Expected includes %v, got %v", expected, files)
+	}
+	if includes[4].Repeat != "multiple-files" {
+		t.Error("Expected the explicit include to take precedence over the glob match")
+	}
+
+	h.AssertNoError(m.Build())
+	h.AssertFileContains("output/base/net/policy.yaml", "file: base/net/policy.yaml")
+	h.AssertFileContains("output/base/special-a.yaml", "file: base/special.yaml")
+	if h.FileExists("output/monitoring/c-test.yaml") || h.FileExists("output/base/special.yaml") {
+		t.Error("Expected excluded and explicitly listed files not to be rendered by the glob")
+	}
+}
+
+func TestGlobIncludeErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		include string
+		wantErr string
+	}{
+		{"no match", "  - file: missing/*.yaml\n", "include pattern missing/*.yaml matched no template files"},
+		{"all excluded", "  - file: '*.yaml'\n    exclude: ['app*']\n", "all 1 matching template file(s) are excluded"},
+		{"exclude without glob", "  - file: app.yaml\n    exclude: ['x']\n", "exclude can only be used when file is a glob pattern"},
+		{"bad pattern", "  - file: '[.yaml'\n", "invalid glob pattern"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "include:\n"+tt.include)
+			h.CreateFile("templates/app.yaml", "a: 1\n")
+
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// referencePattern matches "${name}" references and the "$${" escape
+var referencePattern = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// variableResolver resolves "${name}" references between variables
+type variableResolver struct {
+	raw      map[string]interface{}
+	resolved map[string]interface{}
+	visiting map[string]bool
+	stack    []string
+}
+
+// ResolveVariableReferences replaces "${name}" references inside variable values
+// with the value of the referenced variable. Nested values can be reached with
+// a dotted path ("${db.host}"), and "$${" produces a literal "${".
+// A value made of a single reference keeps the type of the referenced value.
+// Reference cycles and undefined variables are reported as errors.
+func ResolveVariableReferences(variables map[string]interface{}) (map[string]interface{}, error) {
+	r := &variableResolver{
+		raw:      variables,
+		resolved: make(map[string]interface{}, len(variables)),
+		visiting: make(map[string]bool),
+	}
+
+	for _, name := range sortedKeys(variables) {
+		if _, err := r.resolveName(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return r.resolved, nil
+}
+
+// ResolveConfigVariables resolves the references between the variables of a
+// merged config in place. The values as declared stay available through
+// DeclaredValues.
+func ResolveConfigVariables(config *Config) error {
+	raw := config.DeclaredValues()
+	resolved, err := ResolveVariableReferences(raw)
+	if err != nil {
+		return err
+	}
+	config.declared = raw
+
+	for i, v := range config.Variables {
+		config.Variables[i].Value = resolved[v.Name]
+	}
+	return nil
+}
+
+// resolveName resolves a single variable, detecting reference cycles
+func (r *variableResolver) resolveName(name string) (interface{}, error) {
+	if value, done := r.resolved[name]; done {
+		return value, nil
+	}
+
+	if r.visiting[name] {
+		start := 0
+		for i, n := range r.stack {
+			if n == name {
+				start = i
+				break
+			}
+		}
+		cycle := append(append([]string{}, r.stack[start:]...), name)
+		return nil, fmt.Errorf("variable reference cycle: %s", strings.Join(cycle, " -> "))
+	}
+
+	r.visiting[name] = true
+	r.stack = append(r.stack, name)
+
+	value, err := r.resolveValue(r.raw[name], name)
+	if err != nil {
+		return nil, err
+	}
+
+	r.stack = r.stack[:len(r.stack)-1]
+	delete(r.visiting, name)
+	r.resolved[name] = value
+	return value, nil
+}
+
+// resolveValue resolves references in strings nested anywhere inside value
+func (r *variableResolver) resolveValue(value interface{}, owner string) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		return r.resolveString(v, owner)
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			resolved, err := r.resolveValue(item, owner)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, resolved)
+		}
+		return list, nil
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			resolved, err := r.resolveValue(item, owner)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = resolved
+		}
+		return m, nil
+	default:
+		return value, nil
+	}
+}
+
+// resolveString expands the references of a single string
+func (r *variableResolver) resolveString(s, owner string) (interface{}, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	// A value that is exactly one reference keeps the referenced type
+	if loc := referencePattern.FindStringSubmatchIndex(s); loc != nil && loc[0] == 0 && loc[1] == len(s) && loc[2] >= 0 {
+		return r.lookup(s[loc[2]:loc[3]], owner)
+	}
+
+	var resolveErr error
+	result := referencePattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		if resolveErr != nil {
+			return ""
+		}
+		value, err := r.lookup(match[2:len(match)-1], owner)
+		if err != nil {
+			resolveErr = err
+			return ""
+		}
+		return FormatVariableValue(value)
+	})
+	if resolveErr != nil {
+		return nil, resolveErr
+	}
+
+	return result, nil
+}
+
+// lookup returns the resolved value of a reference such as "name" or "db.host"
+func (r *variableResolver) lookup(ref, owner string) (interface{}, error) {
+	ref = strings.TrimSpace(ref)
+	if _, exists := r.raw[ref]; exists {
+		return r.resolveName(ref)
+	}
+
+	path := strings.Split(ref, ".")
+	if _, exists := r.raw[path[0]]; !exists {
+		return nil, fmt.Errorf("variable %s references undefined variable %s", owner, path[0])
+	}
+
+	value, err := r.resolveName(path[0])
+	if err != nil {
+		return nil, err
+	}
+
+	for i, key := range path[1:] {
+		m, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("variable %s references %s, but %s is not a map", owner, ref, strings.Join(path[:i+1], "."))
+		}
+		if value, ok = m[key]; !ok {
+			return nil, fmt.Errorf("variable %s references %s, but %s has no key %s", owner, ref, strings.Join(path[:i+1], "."), key)
+		}
+	}
+
+	return value, nil
+}
+
+// escapeReferences protects "${" in values read from outside the config so
+// they are kept literally
+func escapeReferences(value interface{}) interface{} {
+	switch v := value.(type) {
+	case string:
+		return strings.ReplaceAll(v, "${", "$${")
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, escapeReferences(item))
+		}
+		return list
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = escapeReferences(item)
+		}
+		return m
+	default:
+		return value
+	}
+}
+
+// sortedKeys returns the keys of a variable map in a stable order
+func sortedKeys(variables map[string]interface{}) []string {
+	keys := make([]string, 0, len(variables))
+	for k := range variables {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
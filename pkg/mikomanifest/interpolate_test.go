@@ -0,0 +1,87 @@
+package mikomanifest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestResolveVariableReferences(t *testing.T) {
+	variables := map[string]interface{}{
+		"app_name":    "shop",
+		"environment": "prod",
+		"full_name":   "${app_name}-${environment}",
+		"image":       "registry.local/${full_name}:${tag}",
+		"tag":         "1.2",
+		"db":          map[string]interface{}{"host": "db.${environment}.local", "port": 5432},
+		"db_url":      "postgres://${db.host}:${db.port}",
+		"ports":       []interface{}{80, 443},
+		"all_ports":   "${ports}",
+		"literal":     "$${not_a_reference}",
+		"replicas":    3,
+	}
+
+	resolved, err := ResolveVariableReferences(variables)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app_name":    "shop",
+		"environment": "prod",
+		"full_name":   "shop-prod",
+		"image":       "registry.local/shop-prod:1.2",
+		"tag":         "1.2",
+		"db":          map[string]interface{}{"host": "db.prod.local", "port": 5432},
+		"db_url":      "postgres://db.prod.local:5432",
+		"ports":       []interface{}{80, 443},
+		"all_ports":   []interface{}{80, 443},
+		"literal":     "${not_a_reference}",
+		"replicas":    3,
+	}
+
+	if !reflect.DeepEqual(resolved, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, resolved)
+	}
+
+	if variables["full_name"] != "${app_name}-${environment}" {
+		t.Error("Expected input variables to be left untouched")
+	}
+}
+
+func TestResolveVariableReferencesErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		variables map[string]interface{}
+		expected  string
+	}{
+		{
+			name:      "self reference",
+			variables: map[string]interface{}{"a": "${a}"},
+			expected:  "variable reference cycle: a -> a",
+		},
+		{
+			name:      "indirect cycle",
+			variables: map[string]interface{}{"a": "x-${b}", "b": "${c}", "c": "${a}"},
+			expected:  "variable reference cycle: a -> b -> c -> a",
+		},
+		{
+			name:      "undefined variable",
+			variables: map[string]interface{}{"a": "${missing}"},
+			expected:  "variable a references undefined variable missing",
+		},
+		{
+			name:      "missing nested key",
+			variables: map[string]interface{}{"a": "${db.user}", "db": map[string]interface{}{"host": "x"}},
+			expected:  "variable a references db.user, but db has no key user",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ResolveVariableReferences(tt.variables)
+			if err == nil || err.Error() != tt.expected {
+				t.Errorf("Expected error %q, got: %v", tt.expected, err)
+			}
+		})
+	}
+}
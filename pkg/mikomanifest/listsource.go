@@ -0,0 +1,164 @@
+package mikomanifest
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultListKeyField is the column or field that holds the item keys of a
+// list source when none is set
+const DefaultListKeyField = "key"
+
+// ListSource reads the repeat items of an include from a data file: a CSV
+// file with a header row, or a JSON or YAML list of objects. Every column or
+// field becomes an item value.
+type ListSource struct {
+	File string `yaml:"file"`          // Path relative to the config file
+	Key  string `yaml:"key,omitempty"` // Column or field holding the item key, "key" by default
+}
+
+// UnmarshalYAML also accepts the short form listFrom: path, which reads the
+// item keys from the default key field
+func (s *ListSource) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		s.File = node.Value
+		return nil
+	}
+
+	type plain ListSource
+	return node.Decode((*plain)(s))
+}
+
+// String describes the source, e.g. "tenants.csv (key: name)"
+func (s ListSource) String() string {
+	return fmt.Sprintf("%s (key: %s)", s.File, s.keyField())
+}
+
+func (s ListSource) keyField() string {
+	if s.Key == "" {
+		return DefaultListKeyField
+	}
+	return s.Key
+}
+
+// resolveListSources loads the items of every include with a listFrom source.
+// Inline list items are merged over the loaded ones by key.
+func resolveListSources(config *Config, configPath string) error {
+	for i := range config.Include {
+		inc := &config.Include[i]
+		if inc.ListFrom == nil {
+			continue
+		}
+
+		items, err := loadListSource(*inc.ListFrom, resolveRelativePath(configPath, inc.ListFrom.File))
+		if err != nil {
+			return fmt.Errorf("%s: failed to load list from %s: %w", inc.Name(), inc.ListFrom.File, err)
+		}
+		inc.List = mergeListItems(items, inc.List, config.Merge)
+	}
+	return nil
+}
+
+// loadListSource reads the items of a data file, chosen by its extension
+func loadListSource(source ListSource, path string) ([]ListItem, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rows [][]Variable
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		rows, err = readCSVRows(data)
+	case ".json", ".yaml", ".yml":
+		// JSON documents are valid YAML
+		rows, err = readYAMLRows(data)
+	default:
+		return nil, fmt.Errorf("unsupported file type %q (expected .csv, .json, .yaml or .yml)", filepath.Ext(path))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keyField := source.keyField()
+	items := make([]ListItem, 0, len(rows))
+	keys := make(map[string]int)
+	for i, values := range rows {
+		var key string
+		for _, v := range values {
+			if v.Name == keyField {
+				key = FormatVariableValue(v.Value)
+			}
+		}
+		if key == "" {
+			return nil, fmt.Errorf("item %d has no %s", i+1, keyField)
+		}
+		if previous, exists := keys[key]; exists {
+			return nil, fmt.Errorf("duplicate key %q in items %d and %d", key, previous, i+1)
+		}
+		keys[key] = i + 1
+
+		items = append(items, ListItem{Key: key, Values: values})
+	}
+	return items, nil
+}
+
+// readCSVRows reads the rows of a CSV file named by its header row. Cells
+// are typed like --var values, so "3" is a number.
+func readCSVRows(data []byte) ([][]Variable, error) {
+	records, err := csv.NewReader(strings.NewReader(string(data))).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("missing header row")
+	}
+
+	header := records[0]
+	rows := make([][]Variable, 0, len(records)-1)
+	for _, record := range records[1:] {
+		values := make([]Variable, 0, len(header))
+		for i, name := range header {
+			value, err := ParseVariableValue(record[i])
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", name, err)
+			}
+			values = append(values, Variable{Name: name, Value: value})
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
+
+// readYAMLRows reads a list of objects, keeping the field order of each one
+func readYAMLRows(data []byte) ([][]Variable, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("expected a list of objects")
+	}
+
+	var rows [][]Variable
+	for _, node := range root.Content[0].Content {
+		if node.Kind != yaml.MappingNode {
+			return nil, fmt.Errorf("line %d: expected an object", node.Line)
+		}
+		values := make([]Variable, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			value, err := decodeValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, Variable{Name: node.Content[i].Value, Value: value})
+		}
+		rows = append(rows, values)
+	}
+	return rows, nil
+}
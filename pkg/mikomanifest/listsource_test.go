@@ -0,0 +1,140 @@
+package mikomanifest
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadListSource(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("data/tenants.csv", "name,plan,replicas\nacme,gold,3\nglobex,silver,1\n")
+	h.CreateFile("data/tenants.json", `[{"name": "acme", "plan": "gold", "replicas": 3}, {"name": "globex", "plan": "silver", "replicas": 1}]`)
+	h.CreateFile("data/tenants.yaml", "- name: acme\n  plan: gold\n  replicas: 3\n- name: globex\n  plan: silver\n  replicas: 1\n")
+
+	expected := []ListItem{
+		{Key: "acme", Values: []Variable{{Name: "name", Value: "acme"}, {Name: "plan", Value: "gold"}, {Name: "replicas", Value: 3}}},
+		{Key: "globex", Values: []Variable{{Name: "name", Value: "globex"}, {Name: "plan", Value: "silver"}, {Name: "replicas", Value: 1}}},
+	}
+	for _, file := range []string{"tenants.csv", "tenants.json", "tenants.yaml"} {
+		t.Run(file, func(t *testing.T) {
+			items, err := loadListSource(ListSource{File: file, Key: "name"}, filepath.Join(h.TempDir(), "data", file))
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if !reflect.DeepEqual(items, expected) {
+				t.Errorf("Expected items %v, got %v", expected, items)
+			}
+		})
+	}
+}
+
+func TestBuildWithListFrom(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+include:
+  - file: tenant.yaml
+    repeat: multiple-files
+    listFrom:
+      file: data/tenants.csv
+      key: name
+    list:
+      - key: acme
+        values:
+          - name: replicas
+            value: 5
+      - key: initech
+        values:
+          - name: plan
+            value: bronze
+          - name: replicas
+            value: 1
+`)
+	h.CreateFile("config/data/tenants.csv", "name,plan,replicas\nacme,gold,3\nglobex,silver,2\n")
+	h.CreateFile("templates/tenant.yaml", "plan: {{ .plan }}\nreplicas: {{ .replicas }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+
+	h.AssertFileContains("output/tenant-acme.yaml", "plan: gold\nreplicas: 5")
+	h.AssertFileContains("output/tenant-globex.yaml", "plan: silver\nreplicas: 2")
+	h.AssertFileContains("output/tenant-initech.yaml", "plan: bronze\nreplicas: 1")
+}
+
+func TestBuildWithShortListFrom(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+include:
+  - file: tenant.yaml
+    repeat: multiple-files
+    listFrom: data/tenants.csv
+`)
+	h.CreateFile("config/data/tenants.csv", "key,plan\nacme,gold\nglobex,silver\n")
+	h.CreateFile("templates/tenant.yaml", "plan: {{ .plan }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+
+	h.AssertFileContains("output/tenant-acme.yaml", "plan: gold")
+	h.AssertFileContains("output/tenant-globex.yaml", "plan: silver")
+}
+
+func TestListFromErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		data     string
+		expected string
+	}{
+		{
+			name:     "duplicate key",
+			include:  "    repeat: multiple-files\n    listFrom: {file: items.csv}\n",
+			data:     "key,port\na,80\na,81\n",
+			expected: "app.yaml: failed to load list from items.csv: duplicate key \"a\" in items 1 and 2",
+		},
+		{
+			name:     "missing key",
+			include:  "    repeat: multiple-files\n    listFrom: {file: items.csv, key: name}\n",
+			data:     "key,port\na,80\n",
+			expected: "item 1 has no name",
+		},
+		{
+			name:     "unsupported file type",
+			include:  "    repeat: multiple-files\n    listFrom: {file: items.txt}\n",
+			expected: "unsupported file type \".txt\"",
+		},
+		{
+			name:     "missing file",
+			include:  "    repeat: multiple-files\n    listFrom: {file: missing.csv}\n",
+			expected: "failed to load list from missing.csv",
+		},
+		{
+			name:     "without repeat",
+			include:  "    listFrom: {file: items.csv}\n",
+			expected: "app.yaml: listFrom can only be used with repeat: same-file or multiple-files",
+		},
+		{
+			name:     "file without rows",
+			include:  "    repeat: multiple-files\n    listFrom: items.csv\n",
+			data:     "key,port\n",
+			expected: "app.yaml: repeat: multiple-files has no list items",
+		},
+		{
+			name:     "repeat without list",
+			include:  "    repeat: same-file\n",
+			expected: "app.yaml: repeat: same-file has no list items",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "include:\n  - file: app.yaml\n"+tt.include)
+			h.CreateFile("config/items.csv", tt.data)
+			h.CreateFile("config/items.txt", tt.data)
+			h.CreateFile("templates/app.yaml", "port: {{ .port }}\n")
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.expected)
+		})
+	}
+}
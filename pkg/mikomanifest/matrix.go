@@ -0,0 +1,146 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MatrixKeySeparator joins the axis values of a matrix combination into its key
+const MatrixKeySeparator = "-"
+
+// Matrix generates the repeat items of a "repeat: matrix" include: one item
+// per combination of the axis values, each axis value set as a variable
+// named after its axis
+type Matrix struct {
+	Output  string                   `yaml:"output,omitempty"`  // "multiple-files" (default) or "same-file"
+	Axes    []MatrixAxis             `yaml:"axes"`              // In key order
+	Exclude []map[string]interface{} `yaml:"exclude,omitempty"` // Combinations left out, e.g. {region: us, tenant: acme}
+}
+
+// MatrixAxis is a named list of values
+type MatrixAxis struct {
+	Name   string        `yaml:"name"`
+	Values []interface{} `yaml:"values"`
+}
+
+// OutputMode returns the repeat type the matrix items are rendered with
+func (mx *Matrix) OutputMode() string {
+	if mx.Output == "" {
+		return "multiple-files"
+	}
+	return mx.Output
+}
+
+// validate checks the axes and excluded combinations of a matrix
+func (mx *Matrix) validate() error {
+	switch mx.Output {
+	case "", "same-file", "multiple-files":
+	default:
+		return fmt.Errorf("unknown matrix output %q (expected same-file or multiple-files)", mx.Output)
+	}
+
+	if len(mx.Axes) == 0 {
+		return fmt.Errorf("matrix without axes")
+	}
+	axes := make(map[string]bool)
+	for _, axis := range mx.Axes {
+		if axis.Name == "" {
+			return fmt.Errorf("matrix axis without a name")
+		}
+		if axes[axis.Name] {
+			return fmt.Errorf("duplicate matrix axis %s", axis.Name)
+		}
+		axes[axis.Name] = true
+		if len(axis.Values) == 0 {
+			return fmt.Errorf("matrix axis %s has no values", axis.Name)
+		}
+	}
+
+	for _, combination := range mx.Exclude {
+		for name := range combination {
+			if !axes[name] {
+				return fmt.Errorf("matrix exclude refers to unknown axis %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// Items returns one repeat item per combination of the axis values that is
+// not excluded, in axis order: the last axis varies fastest. The key of an
+// item joins its axis values with MatrixKeySeparator.
+func (mx *Matrix) Items() ([]ListItem, error) {
+	combinations := [][]interface{}{{}}
+	for _, axis := range mx.Axes {
+		next := make([][]interface{}, 0, len(combinations)*len(axis.Values))
+		for _, combination := range combinations {
+			for _, value := range axis.Values {
+				next = append(next, append(append([]interface{}{}, combination...), value))
+			}
+		}
+		combinations = next
+	}
+
+	var items []ListItem
+	keys := make(map[string]bool)
+	for _, combination := range combinations {
+		if mx.excludes(combination) {
+			continue
+		}
+
+		parts := make([]string, len(combination))
+		values := make([]Variable, len(combination))
+		for i, value := range combination {
+			parts[i] = fmt.Sprint(value)
+			values[i] = Variable{Name: mx.Axes[i].Name, Value: value}
+		}
+		key := strings.Join(parts, MatrixKeySeparator)
+		if keys[key] {
+			return nil, fmt.Errorf("matrix produces the key %s twice, axis values must not contain %q", key, MatrixKeySeparator)
+		}
+		keys[key] = true
+
+		items = append(items, ListItem{Key: key, Values: values})
+	}
+
+	if len(items) == 0 {
+		return nil, fmt.Errorf("matrix has no combinations left once exclude is applied")
+	}
+	return items, nil
+}
+
+// excludes reports whether a combination matches one of the excluded ones.
+// An excluded combination may leave out axes to match any of their values.
+func (mx *Matrix) excludes(combination []interface{}) bool {
+	for _, excluded := range mx.Exclude {
+		matched := true
+		for i, axis := range mx.Axes {
+			if value, ok := excluded[axis.Name]; ok && fmt.Sprint(value) != fmt.Sprint(combination[i]) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+// expandMatrices turns every matrix include into a repeat of its output
+// mode over the generated items
+func expandMatrices(includes []Include) ([]Include, error) {
+	expanded := make([]Include, 0, len(includes))
+	for _, inc := range includes {
+		if inc.Repeat == "matrix" {
+			items, err := inc.Matrix.Items()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", inc.Name(), err)
+			}
+			inc.Repeat = inc.Matrix.OutputMode()
+			inc.List = items
+		}
+		expanded = append(expanded, inc)
+	}
+	return expanded, nil
+}
@@ -0,0 +1,183 @@
+package mikomanifest
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatrixItems(t *testing.T) {
+	matrix := &Matrix{
+		Axes: []MatrixAxis{
+			{Name: "region", Values: []interface{}{"eu", "us"}},
+			{Name: "tenant", Values: []interface{}{"acme", "globex"}},
+			{Name: "shard", Values: []interface{}{1, 2}},
+		},
+		Exclude: []map[string]interface{}{
+			{"region": "us", "tenant": "acme"},
+			{"shard": 2, "tenant": "globex"},
+		},
+	}
+
+	items, err := matrix.Items()
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var keys []string
+	for _, item := range items {
+		keys = append(keys, item.Key)
+	}
+	expected := []string{"eu-acme-1", "eu-acme-2", "eu-globex-1", "us-globex-1"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Expected keys %v, got %v", expected, keys)
+	}
+
+	values := []Variable{{Name: "region", Value: "eu"}, {Name: "tenant", Value: "acme"}, {Name: "shard", Value: 2}}
+	if !reflect.DeepEqual(items[1].Values, values) {
+		t.Errorf("Expected axis values %v, got %v", values, items[1].Values)
+	}
+}
+
+func TestBuildMatrixRepeat(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: image
+    value: backup:1.0
+include:
+  - file: cronjob.yaml
+    repeat: matrix
+    output: "{{ .region }}/backup-{{ .tenant }}.yaml"
+    matrix:
+      axes:
+        - name: region
+          values: [eu, us]
+        - name: tenant
+          values: [acme, globex]
+      exclude:
+        - { region: us, tenant: acme }
+  - file: tenants.yaml
+    repeat: matrix
+    matrix:
+      output: same-file
+      axes:
+        - name: tenant
+          values: [acme, globex]
+`)
+	h.CreateFile("templates/cronjob.yaml", "name: backup-{{ .region }}-{{ .tenant }}\nimage: {{ .image }}\n")
+	h.CreateFile("templates/tenants.yaml", "---\ntenant: {{ .tenant }}\n")
+
+	out := h.CaptureOutput(func() {
+		h.AssertNoError(New(h.GetBuildOptions()).Build())
+	})
+
+	h.AssertFileContains("output/eu/backup-acme.yaml", "name: backup-eu-acme\nimage: backup:1.0")
+	h.AssertFileContains("output/eu/backup-globex.yaml", "name: backup-eu-globex")
+	h.AssertFileContains("output/us/backup-globex.yaml", "name: backup-us-globex")
+	if h.FileExists("output/us/backup-acme.yaml") {
+		t.Error("Expected the excluded combination not to be built")
+	}
+	h.AssertFileContains("output/tenants.yaml", "---\ntenant: acme\n\n---\ntenant: globex")
+	h.AssertStringContains(out, "PROCESSED: tenants.yaml -> tenants.yaml (2 sections)")
+}
+
+func TestMatrixErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		include  string
+		expected string
+	}{
+		{
+			name:     "missing matrix",
+			include:  "  - file: app.yaml\n    repeat: matrix\n",
+			expected: "app.yaml: repeat: matrix requires a matrix section",
+		},
+		{
+			name:     "matrix without repeat",
+			include:  "  - file: app.yaml\n    matrix:\n      axes: [{name: a, values: [1]}]\n",
+			expected: "app.yaml: matrix can only be used with repeat: matrix",
+		},
+		{
+			name:     "matrix with list",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    list: [{key: x}]\n    matrix:\n      axes: [{name: a, values: [1]}]\n",
+			expected: "app.yaml: matrix cannot be combined with list",
+		},
+		{
+			name:     "unknown output",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    matrix:\n      output: folders\n      axes: [{name: a, values: [1]}]\n",
+			expected: "unknown matrix output \"folders\"",
+		},
+		{
+			name:     "axis without values",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    matrix:\n      axes: [{name: a, values: []}]\n",
+			expected: "matrix axis a has no values",
+		},
+		{
+			name:     "duplicate axis",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    matrix:\n      axes: [{name: a, values: [1]}, {name: a, values: [2]}]\n",
+			expected: "duplicate matrix axis a",
+		},
+		{
+			name:     "exclude with unknown axis",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    matrix:\n      axes: [{name: a, values: [1]}]\n      exclude: [{b: 1}]\n",
+			expected: "matrix exclude refers to unknown axis b",
+		},
+		{
+			name:     "everything excluded",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    matrix:\n      axes: [{name: a, values: [1]}]\n      exclude: [{a: 1}]\n",
+			expected: "app.yaml: matrix has no combinations left once exclude is applied",
+		},
+		{
+			name:     "ambiguous keys",
+			include:  "  - file: app.yaml\n    repeat: matrix\n    matrix:\n      axes: [{name: a, values: [x-y, x]}, {name: b, values: [z, y-z]}]\n",
+			expected: "matrix produces the key x-y-z twice",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", "include:\n"+tt.include)
+			h.CreateFile("templates/app.yaml", "a: {{ .a }}\n")
+			h.AssertErrorContains(New(h.GetBuildOptions()).Build(), tt.expected)
+		})
+	}
+}
+
+func TestOverlayInheritsMatrix(t *testing.T) {
+	h := NewTestHelper(t)
+	h.CreateFile("config/base.yaml", `include:
+  - id: backups
+    file: backup.yaml
+    repeat: matrix
+    matrix:
+      axes:
+        - name: region
+          values: [eu, us]
+`)
+	h.CreateFile("config/test.yaml", `resources:
+  - base.yaml
+include:
+  - id: backups
+    repeat: matrix
+    output: "nightly-{{ .region }}.yaml"
+  - id: restores
+    file: backup.yaml
+    repeat: matrix
+`)
+	h.CreateFile("templates/backup.yaml", "region: {{ .region }}\n")
+
+	h.AssertErrorContains(New(h.GetBuildOptions()).Build(), "restores: repeat: matrix requires a matrix section")
+
+	h.CreateFile("config/test.yaml", `resources:
+  - base.yaml
+include:
+  - id: backups
+    repeat: matrix
+    output: "nightly-{{ .region }}.yaml"
+`)
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/nightly-eu.yaml", "region: eu")
+	h.AssertFileContains("output/nightly-us.yaml", "region: us")
+}
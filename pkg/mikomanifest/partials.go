@@ -0,0 +1,129 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// HelperFilePrefix and HelperFileExtension mark template files that only hold
+// {{define}} blocks (e.g. "_helpers.tpl"). They are loaded into every template
+// and never emitted. Other files starting with "_" are ordinary templates.
+const (
+	HelperFilePrefix    = "_"
+	HelperFileExtension = ".tpl"
+)
+
+// maxIncludeDepth bounds nested include calls so recursive helpers fail
+// instead of exhausting the stack
+const maxIncludeDepth = 100
+
+// partial is a helper file loaded into every template set
+type partial struct {
+	name    string // Path relative to the templates directory
+	content string
+}
+
+// IsHelperFile reports whether a template path names a helper file
+func IsHelperFile(path string) bool {
+	base := filepath.Base(path)
+	return strings.HasPrefix(base, HelperFilePrefix) && filepath.Ext(base) == HelperFileExtension
+}
+
+// LoadPartials loads the helper files of the templates directory and the
+// partials listed in the configuration. Partials are paths or glob patterns
+// relative to the templates directory. It returns the loaded files as slash
+// separated paths relative to it, which are never built themselves.
+func (m *MikoManifest) LoadPartials(partials []string) ([]string, error) {
+	var paths []string
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if !seen[path] {
+			paths = append(paths, path)
+			seen[path] = true
+		}
+	}
+
+	err := filepath.WalkDir(m.options.TemplatesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && IsHelperFile(path) {
+			add(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find helper files in %s: %w", m.options.TemplatesDir, err)
+	}
+
+	for _, pattern := range partials {
+		matches, err := filepath.Glob(filepath.Join(m.options.TemplatesDir, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid partial pattern %s: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("partial %s not found in %s", pattern, m.options.TemplatesDir)
+		}
+		sort.Strings(matches)
+		for _, match := range matches {
+			add(match)
+		}
+	}
+
+	m.partials = nil
+	names := make([]string, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read partial %s: %w", path, err)
+		}
+		name, err := filepath.Rel(m.options.TemplatesDir, path)
+		if err != nil {
+			name = path
+		}
+		m.partials = append(m.partials, partial{name: filepath.ToSlash(name), content: string(content)})
+		names = append(names, filepath.ToSlash(name))
+	}
+
+	// Report syntax errors in the helpers themselves once
+	if _, err := m.newTemplate(""); err != nil {
+		return nil, err
+	}
+	return names, nil
+}
+
+// newTemplate creates a template set with the function library and the
+// {{define}} blocks of every partial. The include function executes a named
+// template of the set and returns its output, so it can be piped to indent.
+func (m *MikoManifest) newTemplate(name string) (*template.Template, error) {
+	tmpl := template.New(name)
+
+	depth := 0
+	funcs := TemplateFuncMap()
+	funcs["include"] = func(name string, data interface{}) (string, error) {
+		if depth >= maxIncludeDepth {
+			return "", fmt.Errorf("include %s: nested more than %d levels, check for recursive helpers", name, maxIncludeDepth)
+		}
+		depth++
+		defer func() { depth-- }()
+
+		var result strings.Builder
+		if err := tmpl.ExecuteTemplate(&result, name, data); err != nil {
+			return "", err
+		}
+		return result.String(), nil
+	}
+	tmpl.Funcs(funcs)
+
+	for _, p := range m.partials {
+		if _, err := tmpl.New(p.name).Parse(p.content); err != nil {
+			return nil, fmt.Errorf("failed to parse partial %s: %w", p.name, err)
+		}
+	}
+	return tmpl, nil
+}
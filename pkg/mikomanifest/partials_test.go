@@ -0,0 +1,172 @@
+package mikomanifest
+
+import (
+	"testing"
+)
+
+const helpersTemplate = `{{- define "labels" -}}
+app: {{ .app_name }}
+team: {{ .team }}
+{{- end }}
+{{- define "securityContext" -}}
+runAsNonRoot: true
+readOnlyRootFilesystem: true
+{{- end }}`
+
+func TestPartialsInIncludeModes(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+partials:
+  - common/*.tpl
+variables:
+  - name: app_name
+    value: my-app
+  - name: team
+    value: platform
+include:
+  - file: deployment.yaml
+  - file: service.yaml
+    repeat: same-file
+    list:
+      - key: api
+        values:
+          - name: port
+            value: 80
+  - file: configmap.yaml
+    repeat: multiple-files
+    list:
+      - key: web
+        values: []
+`)
+	h.CreateFile("templates/_helpers.tpl", helpersTemplate)
+	h.CreateFile("templates/common/ports.tpl", `{{ define "port" }}port: {{ .port }}{{ end }}`)
+	h.CreateFile("templates/deployment.yaml", `metadata:
+  labels:
+    {{- include "labels" . | nindent 4 }}
+spec:
+  securityContext:
+    {{- include "securityContext" . | nindent 4 }}
+`)
+	h.CreateFile("templates/service.yaml", "labels:\n{{ include \"labels\" . | indent 2 }}\n{{ template \"port\" . }}\n")
+	h.CreateFile("templates/configmap.yaml", "labels: {{ include \"labels\" . | replace \"\\n\" \", \" }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+
+	h.AssertFileContains("output/deployment.yaml", "  labels:\n    app: my-app\n    team: platform\nspec:")
+	h.AssertFileContains("output/deployment.yaml", "  securityContext:\n    runAsNonRoot: true\n    readOnlyRootFilesystem: true")
+	h.AssertFileContains("output/service.yaml", "labels:\n  app: my-app\n  team: platform\nport: 80")
+	h.AssertFileContains("output/configmap-web.yaml", "labels: app: my-app, team: platform")
+	if h.FileExists("output/_helpers.tpl") || h.FileExists("output/ports.tpl") {
+		t.Error("Expected helper files not to be emitted")
+	}
+}
+
+func TestUnderscoreTemplatesAreNotHelpers(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: namespace
+    value: shop
+include:
+  - file: _namespace.yaml
+  - file: apps/*.yaml
+`)
+	h.CreateFile("templates/_namespace.yaml", "name: {{ .namespace }}\n")
+	h.CreateFile("templates/apps/_base.yaml", "base: {{ .namespace }}\n")
+	h.CreateFile("templates/apps/_helpers.tpl", `{{ define "x" }}x{{ end }}`)
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+
+	h.AssertFileContains("output/_namespace.yaml", "name: shop")
+	h.AssertFileContains("output/apps/_base.yaml", "base: shop")
+	if h.FileExists("output/apps/_helpers.tpl") {
+		t.Error("Expected _helpers.tpl to stay a helper file")
+	}
+}
+
+func TestConfiguredPartialsAreNotBuilt(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+partials:
+  - shared/labels.yaml
+variables:
+  - name: app_name
+    value: my-app
+include:
+  - file: "shared/*.yaml"
+`)
+	h.CreateFile("templates/shared/labels.yaml", `{{ define "labels" }}app: {{ .app_name }}{{ end }}`)
+	h.CreateFile("templates/shared/service.yaml", "labels:\n  {{ include \"labels\" . }}\n")
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+
+	h.AssertFileContains("output/shared/service.yaml", "labels:\n  app: my-app")
+	if h.FileExists("output/shared/labels.yaml") {
+		t.Error("Expected the partial not to be emitted")
+	}
+}
+
+func TestPartialErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		files    map[string]string
+		strict   bool
+		expected string
+	}{
+		{
+			name:     "helper file included",
+			config:   "include:\n  - file: _helpers.tpl\n",
+			files:    map[string]string{"_helpers.tpl": helpersTemplate},
+			expected: "_helpers.tpl is a helper file and cannot be included",
+		},
+		{
+			name:     "partial included",
+			config:   "partials:\n  - shared/*.yaml\ninclude:\n  - file: ./shared/labels.yaml\n",
+			files:    map[string]string{"shared/labels.yaml": `{{ define "labels" }}{{ end }}`},
+			expected: "./shared/labels.yaml is a partial and cannot be included",
+		},
+		{
+			name:     "partial not found",
+			config:   "partials:\n  - missing.tpl\ninclude:\n  - file: app.yaml\n",
+			files:    map[string]string{"app.yaml": "a: 1\n"},
+			expected: "partial missing.tpl not found",
+		},
+		{
+			name:     "syntax error in helper",
+			config:   "include:\n  - file: app.yaml\n",
+			files:    map[string]string{"_helpers.tpl": `{{ define "x" }}{{ .a }`, "app.yaml": "a: 1\n"},
+			expected: "failed to parse partial _helpers.tpl",
+		},
+		{
+			name:     "recursive helper",
+			config:   "include:\n  - file: app.yaml\n",
+			files:    map[string]string{"_helpers.tpl": `{{ define "loop" }}{{ include "loop" . }}{{ end }}`, "app.yaml": `{{ include "loop" . }}`},
+			expected: "nested more than 100 levels",
+		},
+		{
+			name:     "missing key in helper with strict mode",
+			config:   "variables:\n  - name: app_name\n    value: my-app\ninclude:\n  - file: app.yaml\n",
+			files:    map[string]string{"_helpers.tpl": helpersTemplate, "app.yaml": `{{ include "labels" . }}`},
+			strict:   true,
+			expected: "app.yaml: team (_helpers.tpl line 3)",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/test.yaml", tt.config)
+			for name, content := range tt.files {
+				h.CreateFile("templates/"+name, content)
+			}
+
+			options := h.GetBuildOptions()
+			options.Strict = tt.strict
+			h.AssertErrorContains(New(options).Build(), tt.expected)
+		})
+	}
+}
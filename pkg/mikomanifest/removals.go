@@ -0,0 +1,60 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+)
+
+// Exclusions lists includes and schemas a config removes from the layers it
+// inherits from its resources
+type Exclusions struct {
+	Include []string `yaml:"include,omitempty"` // Include ids, template paths or glob patterns
+	Schemas []string `yaml:"schemas,omitempty"` // Schema entries, as written in the resources
+}
+
+// Removal records an inherited variable, include or schema that a layer removed
+type Removal struct {
+	Kind  string // "variable", "include" or "schema"
+	Name  string
+	Layer string // Config file that removed it
+}
+
+// String describes the removal, e.g. "variable debug_port (removed by prod.yaml)"
+func (r Removal) String() string {
+	return fmt.Sprintf("%s %s (removed by %s)", r.Kind, r.Name, r.Layer)
+}
+
+// excludesInclude reports whether an inherited include is excluded, by its
+// id or by its file
+func (e Exclusions) excludesInclude(inc Include) bool {
+	for _, pattern := range e.Include {
+		if inc.ID != "" && pattern == inc.ID {
+			return true
+		}
+		if matchGlob(path.Clean(filepath.ToSlash(pattern)), path.Clean(filepath.ToSlash(inc.File))) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludesSchema reports whether an inherited schema entry is excluded
+func (e Exclusions) excludesSchema(schema string) bool {
+	for _, excluded := range e.Schemas {
+		if excluded == schema {
+			return true
+		}
+	}
+	return false
+}
+
+// validateExclusions checks the exclude section of a single config file
+func validateExclusions(config *Config) error {
+	for _, pattern := range config.Exclude.Include {
+		if _, err := path.Match(filepath.ToSlash(pattern), ""); err != nil {
+			return fmt.Errorf("invalid include pattern %s: %w", pattern, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ResourceOptions controls how the resources of a config file are expanded.
+// It applies to the resources of the file that declares it.
+type ResourceOptions struct {
+	Recursive bool `yaml:"recursive,omitempty"` // Directory resources also load the YAML files of their subdirectories
+}
+
+// expandResource returns the config files a resource stands for, in load
+// order. A directory yields its YAML files, and with recursive those of its
+// subdirectories. A glob pattern, where "**" matches any number of
+// directories, yields the YAML files it matches. Files of a directory come
+// before its subdirectories and both are sorted by name, so the order is
+// the same on every machine.
+func expandResource(configPath, resource string, recursive bool) ([]string, error) {
+	resourcePath := resolveRelativePath(configPath, resource)
+
+	if IsGlobPattern(resource) {
+		pattern := filepath.ToSlash(resourcePath)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid resource pattern %s: %w", resource, err)
+		}
+
+		var matches []string
+		if base := globBaseDir(resourcePath); isDirectory(base) {
+			files, err := findConfigFiles(base, true)
+			if err != nil {
+				return nil, err
+			}
+			for _, file := range files {
+				if matchGlob(pattern, filepath.ToSlash(file)) {
+					matches = append(matches, file)
+				}
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("resource pattern %s matched no YAML files", resource)
+		}
+		return matches, nil
+	}
+
+	if isDirectory(resourcePath) {
+		return findConfigFiles(resourcePath, recursive)
+	}
+	return []string{resourcePath}, nil
+}
+
+// globBaseDir returns the directory a glob pattern is rooted at: its leading
+// segments without wildcards
+func globBaseDir(pattern string) string {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	for i, segment := range segments {
+		if IsGlobPattern(segment) {
+			if i == 0 {
+				return "."
+			}
+			if i == 1 && segments[0] == "" {
+				return "/"
+			}
+			return filepath.FromSlash(strings.Join(segments[:i], "/"))
+		}
+	}
+	return filepath.Dir(pattern)
+}
+
+// findConfigFiles returns the .yaml and .yml files of a directory sorted by
+// name, followed with recursive by those of each subdirectory in name order
+func findConfigFiles(dir string, recursive bool) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	var files, subdirs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			subdirs = append(subdirs, filepath.Join(dir, name))
+		} else if strings.HasSuffix(name, ".yaml") || strings.HasSuffix(name, ".yml") {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	if recursive {
+		for _, subdir := range subdirs {
+			nested, err := findConfigFiles(subdir, true)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, nested...)
+		}
+	}
+	return files, nil
+}
@@ -0,0 +1,152 @@
+package mikomanifest
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// loadOrder returns the files that set the "layer" variable, in merge order
+func loadOrder(t *testing.T, h *TestHelper, env string) []string {
+	t.Helper()
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), env, false)
+	h.AssertNoError(err)
+
+	layer, found := config.FindVariable("layer")
+	if !found {
+		t.Fatal("Expected layer variable to be defined")
+	}
+	var files []string
+	for _, origin := range layer.Origins {
+		rel, _ := filepath.Rel(filepath.Join(h.TempDir(), "config"), origin.File)
+		files = append(files, filepath.ToSlash(rel))
+	}
+	return files
+}
+
+func TestGlobAndRecursiveResources(t *testing.T) {
+	h := NewTestHelper(t)
+	for _, file := range []string{
+		"common/b.yaml",
+		"common/a.yaml",
+		"common/notes.txt",
+		"teams/zeta.yaml",
+		"teams/beta.yml",
+		"teams/alpha/one.yaml",
+		"teams/alpha/nested/deep.yaml",
+	} {
+		h.CreateFile("config/"+file, "variables:\n  - name: layer\n    value: "+file+"\n")
+	}
+
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{
+			name:     "glob patterns",
+			config:   "resources:\n  - common/*.yaml\n  - teams/**\n",
+			expected: []string{"common/a.yaml", "common/b.yaml", "teams/beta.yml", "teams/zeta.yaml", "teams/alpha/one.yaml", "teams/alpha/nested/deep.yaml"},
+		},
+		{
+			name:     "double star in the middle",
+			config:   "resources:\n  - teams/**/*.yaml\n",
+			expected: []string{"teams/zeta.yaml", "teams/alpha/one.yaml", "teams/alpha/nested/deep.yaml"},
+		},
+		{
+			name:     "directory",
+			config:   "resources:\n  - teams/\n",
+			expected: []string{"teams/beta.yml", "teams/zeta.yaml"},
+		},
+		{
+			name:     "recursive directory",
+			config:   "resourceOptions:\n  recursive: true\nresources:\n  - teams/\n",
+			expected: []string{"teams/beta.yml", "teams/zeta.yaml", "teams/alpha/one.yaml", "teams/alpha/nested/deep.yaml"},
+		},
+		{
+			name:     "files are loaded once",
+			config:   "resources:\n  - teams/alpha/one.yaml\n  - teams/**/*.yaml\n  - teams/\n",
+			expected: []string{"teams/alpha/one.yaml", "teams/zeta.yaml", "teams/alpha/nested/deep.yaml", "teams/beta.yml"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h.CreateFile("config/dev.yaml", tt.config+"variables:\n  - name: layer\n    value: dev\n")
+			expected := append(tt.expected, "dev.yaml")
+			if files := loadOrder(t, h, "dev"); !reflect.DeepEqual(files, expected) {
+				t.Errorf("Expected load order %v, got %v", expected, files)
+			}
+		})
+	}
+}
+
+func TestResourceExpansionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			name:     "pattern without matches",
+			files:    map[string]string{"dev.yaml": "resources:\n  - missing/*.yaml\n"},
+			expected: "resource pattern missing/*.yaml matched no YAML files",
+		},
+		{
+			name:     "invalid pattern",
+			files:    map[string]string{"dev.yaml": "resources:\n  - \"teams/[a.yaml\"\n"},
+			expected: "invalid resource pattern teams/[a.yaml",
+		},
+		{
+			name:     "pattern matching the config itself",
+			files:    map[string]string{"dev.yaml": "resources:\n  - \"*.yaml\"\n"},
+			expected: "circular dependency detected",
+		},
+		{
+			name: "circular dependency in a subdirectory",
+			files: map[string]string{
+				"dev.yaml":           "resourceOptions:\n  recursive: true\nresources:\n  - teams/\n",
+				"teams/api/api.yaml": "resources:\n  - ../../dev.yaml\n",
+			},
+			expected: "circular dependency detected",
+		},
+		{
+			name: "depth of expanded files",
+			files: map[string]string{
+				"dev.yaml":  "resources:\n  - l1/**\n",
+				"l1/a.yaml": "resources:\n  - ../l2/*.yaml\n",
+				"l2/a.yaml": "resources:\n  - ../l3/*.yaml\n",
+				"l3/a.yaml": "resources:\n  - ../l4/*.yaml\n",
+				"l4/a.yaml": "resources:\n  - ../l5/*.yaml\n",
+				"l5/a.yaml": "resources:\n  - ../l6/*.yaml\n",
+				"l6/a.yaml": "variables: []\n",
+			},
+			expected: "maximum recursion depth (5) exceeded",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			for name, content := range tt.files {
+				h.CreateFile("config/"+name, content)
+			}
+			_, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+			h.AssertErrorContains(err, tt.expected)
+		})
+	}
+}
+
+func TestDetectEnvironmentsWithResourcePatterns(t *testing.T) {
+	h := NewTestHelper(t)
+	h.CreateFile("config/shared-base.yaml", "variables: []\n")
+	h.CreateFile("config/shared-extra.yaml", "variables: []\n")
+	h.CreateFile("config/dev.yaml", "resources:\n  - shared-*.yaml\n")
+	h.CreateFile("config/prod.yaml", "resources:\n  - shared-base.yaml\n")
+
+	environments, err := DetectEnvironments(filepath.Join(h.TempDir(), "config"))
+	h.AssertNoError(err)
+	if expected := []string{"dev", "prod"}; !reflect.DeepEqual(environments, expected) {
+		t.Errorf("Expected environments %v, got %v", expected, environments)
+	}
+}
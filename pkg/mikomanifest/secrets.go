@@ -0,0 +1,578 @@
+package mikomanifest
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"filippo.io/age"
+	"filippo.io/age/armor"
+	"gopkg.in/yaml.v3"
+)
+
+// Encrypted config files follow the SOPS format: every selected value is
+// encrypted with AES256-GCM using a random data key, and the data key is
+// encrypted for each age recipient in the "sops" metadata section. Files
+// produced here can be decrypted by sops, and files produced by sops with age
+// recipients can be loaded as resources.
+
+const (
+	// AgeKeyEnv holds age identities (the content of an age key file)
+	AgeKeyEnv = "MIKO_AGE_KEY"
+	// AgeKeyFileEnv holds the path of an age key file
+	AgeKeyFileEnv = "MIKO_AGE_KEY_FILE"
+
+	// DefaultEncryptedRegex encrypts variable values and leaves names readable
+	DefaultEncryptedRegex = "^value$"
+
+	sopsMetadataKey = "sops"
+	sopsVersion     = "3.9.0"
+	sopsNonceSize   = 32
+	sopsDataKeySize = 32
+)
+
+// sopsValuePattern matches a value encrypted by SOPS
+var sopsValuePattern = regexp.MustCompile(`^ENC\[AES256_GCM,data:(.*),iv:(.+),tag:(.+),type:(.+)\]$`)
+
+// EncryptOptions contains options for encrypting a config file
+type EncryptOptions struct {
+	Recipients     []string // age recipients (age1...)
+	EncryptedRegex string   // Only keys matching this regex are encrypted (DefaultEncryptedRegex if empty)
+}
+
+// sopsAgeKey is the data key encrypted for one age recipient
+type sopsAgeKey struct {
+	Recipient string `yaml:"recipient"`
+	Enc       string `yaml:"enc"`
+}
+
+// sopsMetadata is the "sops" section of an encrypted file
+type sopsMetadata struct {
+	Age               []sopsAgeKey `yaml:"age,omitempty"`
+	LastModified      string       `yaml:"lastmodified"`
+	MAC               string       `yaml:"mac"`
+	UnencryptedSuffix string       `yaml:"unencrypted_suffix,omitempty"`
+	EncryptedSuffix   string       `yaml:"encrypted_suffix,omitempty"`
+	UnencryptedRegex  string       `yaml:"unencrypted_regex,omitempty"`
+	EncryptedRegex    string       `yaml:"encrypted_regex,omitempty"`
+	MACOnlyEncrypted  bool         `yaml:"mac_only_encrypted,omitempty"`
+	Version           string       `yaml:"version"`
+}
+
+// shouldEncrypt tells whether the value at path is encrypted, following the
+// SOPS suffix and regex rules
+func (md *sopsMetadata) shouldEncrypt(path []string) bool {
+	anyMatch := func(match func(string) bool) bool {
+		for _, p := range path {
+			if match(p) {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case md.UnencryptedSuffix != "":
+		return !anyMatch(func(p string) bool { return strings.HasSuffix(p, md.UnencryptedSuffix) })
+	case md.EncryptedSuffix != "":
+		return anyMatch(func(p string) bool { return strings.HasSuffix(p, md.EncryptedSuffix) })
+	case md.UnencryptedRegex != "":
+		re, err := regexp.Compile(md.UnencryptedRegex)
+		return err == nil && !anyMatch(re.MatchString)
+	case md.EncryptedRegex != "":
+		re, err := regexp.Compile(md.EncryptedRegex)
+		return err == nil && anyMatch(re.MatchString)
+	default:
+		return true
+	}
+}
+
+// IsEncryptedConfig reports whether data is a SOPS encrypted YAML document
+func IsEncryptedConfig(data []byte) bool {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return false
+	}
+	_, index := sopsMetadataNode(&root)
+	return index >= 0
+}
+
+// LoadAgeIdentities loads the age identities used to decrypt config files from
+// MIKO_AGE_KEY, MIKO_AGE_KEY_FILE or the default SOPS key file
+// ($XDG_CONFIG_HOME/sops/age/keys.txt)
+func LoadAgeIdentities() ([]age.Identity, error) {
+	if key := os.Getenv(AgeKeyEnv); key != "" {
+		identities, err := age.ParseIdentities(strings.NewReader(key))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %w", AgeKeyEnv, err)
+		}
+		return identities, nil
+	}
+
+	keyFile := os.Getenv(AgeKeyFileEnv)
+	if keyFile == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return nil, fmt.Errorf("no age key found: set %s or %s", AgeKeyEnv, AgeKeyFileEnv)
+		}
+		keyFile = filepath.Join(configDir, "sops", "age", "keys.txt")
+	}
+
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("no age key found: set %s or %s (looked for %s)", AgeKeyEnv, AgeKeyFileEnv, keyFile)
+		}
+		return nil, fmt.Errorf("failed to read age key file %s: %w", keyFile, err)
+	}
+
+	identities, err := age.ParseIdentities(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse age key file %s: %w", keyFile, err)
+	}
+	return identities, nil
+}
+
+// DefaultAgeRecipients returns the recipients of the local age identities, so
+// files can be encrypted for the key used to decrypt them
+func DefaultAgeRecipients() ([]string, error) {
+	identities, err := LoadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+
+	var recipients []string
+	for _, identity := range identities {
+		if x25519, ok := identity.(*age.X25519Identity); ok {
+			recipients = append(recipients, x25519.Recipient().String())
+		}
+	}
+	if len(recipients) == 0 {
+		return nil, fmt.Errorf("no X25519 age identity found")
+	}
+	return recipients, nil
+}
+
+// EncryptedConfigOptions returns the recipients and encryption rule of an
+// encrypted config file, to encrypt it again after editing
+func EncryptedConfigOptions(data []byte) (EncryptOptions, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return EncryptOptions{}, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+
+	metadataNode, index := sopsMetadataNode(&root)
+	if index < 0 {
+		return EncryptOptions{}, fmt.Errorf("file is not encrypted (no %s metadata)", sopsMetadataKey)
+	}
+
+	var metadata sopsMetadata
+	if err := metadataNode.Decode(&metadata); err != nil {
+		return EncryptOptions{}, fmt.Errorf("invalid %s metadata: %w", sopsMetadataKey, err)
+	}
+	if metadata.UnencryptedSuffix != "" || metadata.EncryptedSuffix != "" || metadata.UnencryptedRegex != "" {
+		return EncryptOptions{}, fmt.Errorf("only files encrypted with encrypted_regex can be re-encrypted")
+	}
+
+	options := EncryptOptions{EncryptedRegex: metadata.EncryptedRegex}
+	if options.EncryptedRegex == "" {
+		// Files without a rule have every value encrypted
+		options.EncryptedRegex = ".*"
+	}
+	for _, key := range metadata.Age {
+		options.Recipients = append(options.Recipients, key.Recipient)
+	}
+	return options, nil
+}
+
+// EncryptConfig encrypts a plain YAML config file for the given age recipients
+func EncryptConfig(data []byte, options EncryptOptions) ([]byte, error) {
+	if len(options.Recipients) == 0 {
+		return nil, fmt.Errorf("at least one age recipient is required")
+	}
+	if options.EncryptedRegex == "" {
+		options.EncryptedRegex = DefaultEncryptedRegex
+	}
+	if _, err := regexp.Compile(options.EncryptedRegex); err != nil {
+		return nil, fmt.Errorf("invalid encrypted regex: %w", err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("encrypted files must contain a YAML mapping")
+	}
+	if _, index := sopsMetadataNode(&root); index >= 0 {
+		return nil, fmt.Errorf("file is already encrypted")
+	}
+
+	dataKey := make([]byte, sopsDataKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, fmt.Errorf("failed to generate data key: %w", err)
+	}
+
+	metadata := &sopsMetadata{
+		LastModified:   time.Now().UTC().Format(time.RFC3339),
+		EncryptedRegex: options.EncryptedRegex,
+		Version:        sopsVersion,
+	}
+
+	for _, recipient := range options.Recipients {
+		parsed, err := age.ParseX25519Recipient(strings.TrimSpace(recipient))
+		if err != nil {
+			return nil, fmt.Errorf("invalid age recipient %s: %w", recipient, err)
+		}
+		enc, err := encryptDataKey(dataKey, parsed)
+		if err != nil {
+			return nil, err
+		}
+		metadata.Age = append(metadata.Age, sopsAgeKey{Recipient: parsed.String(), Enc: enc})
+	}
+
+	hash := sha512.New()
+	err := walkScalars(root.Content[0], nil, func(node *yaml.Node, path []string) error {
+		plaintext, valueType := sopsPlaintext(node)
+		encrypt := metadata.shouldEncrypt(path)
+		if encrypt || !metadata.MACOnlyEncrypted {
+			hash.Write(plaintext)
+		}
+		if !encrypt || valueType == "" || len(plaintext) == 0 {
+			return nil
+		}
+
+		encrypted, err := sopsEncrypt(plaintext, valueType, dataKey, sopsPath(path))
+		if err != nil {
+			return err
+		}
+		node.Value = encrypted
+		node.Tag = "!!str"
+		node.Style = 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	mac := fmt.Sprintf("%X", hash.Sum(nil))
+	metadata.MAC, err = sopsEncrypt([]byte(mac), "str", dataKey, metadata.LastModified)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadataNode yaml.Node
+	if err := metadataNode.Encode(metadata); err != nil {
+		return nil, fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	mapping := root.Content[0]
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: sopsMetadataKey},
+		&metadataNode,
+	)
+
+	return encodeYAML(&root)
+}
+
+// DecryptConfig decrypts a SOPS encrypted config file with the local age identities
+func DecryptConfig(data []byte) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+
+	identities, err := LoadAgeIdentities()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := decryptConfigNode(&root, identities); err != nil {
+		return nil, err
+	}
+
+	return encodeYAML(&root)
+}
+
+// decryptConfigNode decrypts a parsed SOPS document in place, removing its
+// metadata, and returns the recipients it was encrypted for
+func decryptConfigNode(root *yaml.Node, identities []age.Identity) ([]string, error) {
+	metadataNode, index := sopsMetadataNode(root)
+	if index < 0 {
+		return nil, fmt.Errorf("file is not encrypted (no %s metadata)", sopsMetadataKey)
+	}
+
+	var metadata sopsMetadata
+	if err := metadataNode.Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("invalid %s metadata: %w", sopsMetadataKey, err)
+	}
+	if len(metadata.Age) == 0 {
+		return nil, fmt.Errorf("no age recipients in %s metadata (only age is supported)", sopsMetadataKey)
+	}
+
+	dataKey, err := decryptDataKey(metadata.Age, identities)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remove the metadata so only the config remains
+	mapping := root.Content[0]
+	mapping.Content = append(mapping.Content[:index], mapping.Content[index+2:]...)
+
+	hash := sha512.New()
+	err = walkScalars(mapping, nil, func(node *yaml.Node, path []string) error {
+		encrypt := metadata.shouldEncrypt(path)
+		if encrypt && node.Value != "" {
+			plaintext, valueType, err := sopsDecrypt(node.Value, dataKey, sopsPath(path))
+			if err != nil {
+				return fmt.Errorf("failed to decrypt value at %s: %w", strings.Join(path, "."), err)
+			}
+			setDecryptedScalar(node, string(plaintext), valueType)
+		}
+
+		if encrypt || !metadata.MACOnlyEncrypted {
+			plaintext, _ := sopsPlaintext(node)
+			hash.Write(plaintext)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lastModified := metadata.LastModified
+	if parsed, err := time.Parse(time.RFC3339, lastModified); err == nil {
+		lastModified = parsed.UTC().Format(time.RFC3339)
+	}
+	mac, _, err := sopsDecrypt(metadata.MAC, dataKey, lastModified)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt MAC: %w", err)
+	}
+	if string(mac) != fmt.Sprintf("%X", hash.Sum(nil)) {
+		return nil, fmt.Errorf("MAC mismatch: the file was modified without re-encrypting it")
+	}
+
+	recipients := make([]string, 0, len(metadata.Age))
+	for _, key := range metadata.Age {
+		recipients = append(recipients, key.Recipient)
+	}
+	return recipients, nil
+}
+
+// sopsMetadataNode returns the "sops" value of a document and its key index
+// in the top-level mapping, or -1 if the document is not encrypted
+func sopsMetadataNode(root *yaml.Node) (*yaml.Node, int) {
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, -1
+	}
+	mapping := root.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == sopsMetadataKey && mapping.Content[i+1].Kind == yaml.MappingNode {
+			return mapping.Content[i+1], i
+		}
+	}
+	return nil, -1
+}
+
+// walkScalars calls fn for every scalar value with the path of mapping keys
+// leading to it (sequence indexes are not part of SOPS paths)
+func walkScalars(node *yaml.Node, path []string, fn func(node *yaml.Node, path []string) error) error {
+	switch node.Kind {
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childPath := append(append([]string{}, path...), node.Content[i].Value)
+			if err := walkScalars(node.Content[i+1], childPath, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.SequenceNode:
+		for _, child := range node.Content {
+			if err := walkScalars(child, path, fn); err != nil {
+				return err
+			}
+		}
+	case yaml.AliasNode:
+		return fmt.Errorf("YAML aliases are not supported in encrypted files")
+	case yaml.ScalarNode:
+		return fn(node, path)
+	}
+	return nil
+}
+
+// sopsPath builds the additional authenticated data of a value
+func sopsPath(path []string) string {
+	return strings.Join(path, ":") + ":"
+}
+
+// sopsPlaintext returns the bytes SOPS encrypts and hashes for a scalar, and
+// its SOPS type ("" for null values, which are left untouched)
+func sopsPlaintext(node *yaml.Node) ([]byte, string) {
+	value, _ := decodeScalar(node)
+	switch v := value.(type) {
+	case int:
+		return []byte(strconv.Itoa(v)), "int"
+	case float64:
+		return []byte(strconv.FormatFloat(v, 'f', -1, 64)), "float"
+	case bool:
+		if v {
+			return []byte("True"), "bool"
+		}
+		return []byte("False"), "bool"
+	}
+
+	if node.ShortTag() == "!!null" {
+		return nil, ""
+	}
+	return []byte(node.Value), "str"
+}
+
+// setDecryptedScalar stores a decrypted value keeping its original type
+func setDecryptedScalar(node *yaml.Node, plaintext, valueType string) {
+	node.Style = 0
+	switch valueType {
+	case "int":
+		node.Tag = "!!int"
+		node.Value = plaintext
+	case "float":
+		node.Tag = "!!float"
+		node.Value = plaintext
+	case "bool":
+		node.Tag = "!!bool"
+		node.Value = strings.ToLower(plaintext)
+	default:
+		node.Tag = "!!str"
+		node.Value = plaintext
+		if strings.Contains(plaintext, "\n") {
+			node.Style = yaml.LiteralStyle
+		}
+	}
+}
+
+// sopsEncrypt encrypts a value in the SOPS "ENC[AES256_GCM,...]" format
+func sopsEncrypt(plaintext []byte, valueType string, key []byte, additionalData string) (string, error) {
+	gcm, err := newSopsGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	iv := make([]byte, sopsNonceSize)
+	if _, err := rand.Read(iv); err != nil {
+		return "", fmt.Errorf("failed to generate IV: %w", err)
+	}
+
+	out := gcm.Seal(nil, iv, plaintext, []byte(additionalData))
+	tagStart := len(out) - gcm.Overhead()
+	return fmt.Sprintf("ENC[AES256_GCM,data:%s,iv:%s,tag:%s,type:%s]",
+		base64.StdEncoding.EncodeToString(out[:tagStart]),
+		base64.StdEncoding.EncodeToString(iv),
+		base64.StdEncoding.EncodeToString(out[tagStart:]),
+		valueType), nil
+}
+
+// sopsDecrypt decrypts a SOPS encrypted value and returns it with its type
+func sopsDecrypt(value string, key []byte, additionalData string) ([]byte, string, error) {
+	matches := sopsValuePattern.FindStringSubmatch(value)
+	if matches == nil {
+		return nil, "", fmt.Errorf("value is not in SOPS encrypted format")
+	}
+
+	data, err := base64.StdEncoding.DecodeString(matches[1])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid data: %w", err)
+	}
+	iv, err := base64.StdEncoding.DecodeString(matches[2])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid IV: %w", err)
+	}
+	tag, err := base64.StdEncoding.DecodeString(matches[3])
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid tag: %w", err)
+	}
+
+	gcm, err := newSopsGCM(key)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(iv) != sopsNonceSize {
+		return nil, "", fmt.Errorf("invalid IV size %d", len(iv))
+	}
+
+	plaintext, err := gcm.Open(nil, iv, append(data, tag...), []byte(additionalData))
+	if err != nil {
+		return nil, "", fmt.Errorf("authentication failed: %w", err)
+	}
+	return plaintext, matches[4], nil
+}
+
+// newSopsGCM creates the AES256-GCM cipher used by SOPS (32 byte nonces)
+func newSopsGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid data key: %w", err)
+	}
+	return cipher.NewGCMWithNonceSize(block, sopsNonceSize)
+}
+
+// encryptDataKey encrypts the data key for a recipient as an armored age file
+func encryptDataKey(dataKey []byte, recipient age.Recipient) (string, error) {
+	var buf bytes.Buffer
+	armorWriter := armor.NewWriter(&buf)
+	w, err := age.Encrypt(armorWriter, recipient)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if _, err := w.Write(dataKey); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	if err := armorWriter.Close(); err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// decryptDataKey recovers the data key with the first identity that matches a recipient
+func decryptDataKey(keys []sopsAgeKey, identities []age.Identity) ([]byte, error) {
+	for _, key := range keys {
+		r, err := age.Decrypt(armor.NewReader(strings.NewReader(key.Enc)), identities...)
+		if err != nil {
+			continue
+		}
+		dataKey, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read data key: %w", err)
+		}
+		return dataKey, nil
+	}
+
+	recipients := make([]string, 0, len(keys))
+	for _, key := range keys {
+		recipients = append(recipients, key.Recipient)
+	}
+	return nil, fmt.Errorf("no age identity matches the file recipients (%s)", strings.Join(recipients, ", "))
+}
+
+// encodeYAML writes a YAML document with the indentation used by config files
+func encodeYAML(root *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encode YAML: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,158 @@
+package mikomanifest
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"gopkg.in/yaml.v3"
+)
+
+const plainSecrets = `variables:
+  - name: db_password
+    value: s3cr3t
+  - name: replicas
+    value: 3
+  - name: debug
+    value: true
+  - name: version
+    value: "1.10"
+  - name: db
+    value:
+      user: admin
+      ports: [5432, 5433]
+`
+
+// newTestIdentity creates an age identity and exposes it through MIKO_AGE_KEY
+func newTestIdentity(t *testing.T) *age.X25519Identity {
+	t.Helper()
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		t.Fatalf("Failed to generate age identity: %v", err)
+	}
+	t.Setenv(AgeKeyEnv, identity.String())
+	return identity
+}
+
+func TestEncryptDecryptConfigRoundTrip(t *testing.T) {
+	h := NewTestHelper(t)
+	identity := newTestIdentity(t)
+
+	encrypted, err := EncryptConfig([]byte(plainSecrets), EncryptOptions{
+		Recipients: []string{identity.Recipient().String()},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	content := string(encrypted)
+	if strings.Contains(content, "s3cr3t") || strings.Contains(content, "admin") {
+		t.Errorf("Expected values to be encrypted, got:\n%s", content)
+	}
+	if !strings.Contains(content, "name: db_password") {
+		t.Errorf("Expected variable names to stay readable, got:\n%s", content)
+	}
+	if !IsEncryptedConfig(encrypted) || IsEncryptedConfig([]byte(plainSecrets)) {
+		t.Error("Expected only the encrypted file to be detected as encrypted")
+	}
+
+	decrypted, err := DecryptConfig(encrypted)
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	var expected, got Config
+	if err := yaml.Unmarshal([]byte(plainSecrets), &expected); err != nil {
+		t.Fatalf("Failed to parse plain config: %v", err)
+	}
+	if err := yaml.Unmarshal(decrypted, &got); err != nil {
+		t.Fatalf("Failed to parse decrypted config: %v", err)
+	}
+	for i, v := range expected.Variables {
+		if !reflect.DeepEqual(got.Variables[i].Value, v.Value) {
+			t.Errorf("Variable %s: expected %#v, got %#v", v.Name, v.Value, got.Variables[i].Value)
+		}
+	}
+
+	options, err := EncryptedConfigOptions(encrypted)
+	h.AssertNoError(err)
+	if options.EncryptedRegex != DefaultEncryptedRegex || len(options.Recipients) != 1 {
+		t.Errorf("Expected the original encryption options, got %+v", options)
+	}
+}
+
+func TestDecryptConfigErrors(t *testing.T) {
+	h := NewTestHelper(t)
+	identity := newTestIdentity(t)
+
+	encrypted, err := EncryptConfig([]byte(plainSecrets), EncryptOptions{
+		Recipients: []string{identity.Recipient().String()},
+	})
+	h.AssertNoError(err)
+
+	// A corrupted encrypted value fails authentication
+	var root yaml.Node
+	h.AssertNoError(yaml.Unmarshal(encrypted, &root))
+	value := root.Content[0].Content[1].Content[0].Content[3]
+	value.Value = strings.Replace(value.Value, "data:", "data:AAAA", 1)
+	tampered, err := encodeYAML(&root)
+	h.AssertNoError(err)
+	_, err = DecryptConfig(tampered)
+	h.AssertErrorContains(err, "failed to decrypt value")
+
+	// Changing an unencrypted value is detected by the MAC
+	_, err = DecryptConfig([]byte(strings.Replace(string(encrypted), "name: replicas", "name: workers", 1)))
+	h.AssertErrorContains(err, "MAC mismatch")
+
+	// Only the recipients can decrypt the file
+	newTestIdentity(t)
+	_, err = DecryptConfig(encrypted)
+	h.AssertErrorContains(err, "no age identity matches")
+
+	_, err = EncryptConfig(encrypted, EncryptOptions{Recipients: []string{identity.Recipient().String()}})
+	h.AssertErrorContains(err, "already encrypted")
+}
+
+func TestLoadEncryptedResource(t *testing.T) {
+	h := NewTestHelper(t)
+	identity := newTestIdentity(t)
+
+	encrypted, err := EncryptConfig([]byte(plainSecrets), EncryptOptions{
+		Recipients: []string{identity.Recipient().String()},
+	})
+	h.AssertNoError(err)
+
+	h.CreateFile("config/secrets.enc.yaml", string(encrypted))
+	h.CreateFile("config/dev.yaml", `---
+resources:
+  - secrets.enc.yaml
+variables:
+  - name: replicas
+    value: 5
+`)
+
+	configDir := filepath.Join(h.TempDir(), "config")
+	config, err := LoadConfig(configDir, "dev", false)
+	h.AssertNoError(err)
+
+	password, found := config.FindVariable("db_password")
+	if !found || password.Value != "s3cr3t" {
+		t.Fatalf("Expected decrypted db_password, got %#v", password)
+	}
+	if !password.Sensitive || password.DisplayValue() != MaskedValue {
+		t.Error("Expected variables from encrypted files to be sensitive")
+	}
+	if origin := password.Origins[0]; origin.Line != 2 {
+		t.Errorf("Expected origin line 2 in the encrypted file, got %s", origin)
+	}
+	if replicas, _ := config.FindVariable("replicas"); replicas.Value != 5 {
+		t.Errorf("Expected replicas to be overridden by dev.yaml, got %#v", replicas.Value)
+	}
+
+	t.Setenv(AgeKeyEnv, "")
+	t.Setenv(AgeKeyFileEnv, filepath.Join(h.TempDir(), "missing-keys.txt"))
+	_, err = LoadConfig(configDir, "dev", false)
+	h.AssertErrorContains(err, "no age key found")
+}
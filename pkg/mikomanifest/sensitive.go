@@ -0,0 +1,167 @@
+package mikomanifest
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// DefaultSensitivePatterns are the variable name patterns masked in every
+// environment, in addition to the sensitivePatterns of the config
+var DefaultSensitivePatterns = []string{"*_password", "*_secret", "*_token"}
+
+// minRedactLength is the shortest value replaced in messages, so short values
+// such as "1" or "on" do not garble them
+const minRedactLength = 4
+
+// IsSensitiveName reports whether a variable name matches one of the patterns.
+// Patterns use shell glob syntax ("*_password") and ignore case.
+func IsSensitiveName(name string, patterns []string) bool {
+	name = strings.ToLower(name)
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(strings.ToLower(pattern), name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// IsSensitive reports whether the value of a variable must be masked, either
+// because it is flagged sensitive or because its name matches a pattern
+func (c *Config) IsSensitive(name string) bool {
+	if v, found := c.FindVariable(name); found && v.Sensitive {
+		return true
+	}
+	return IsSensitiveName(name, c.sensitivePatterns())
+}
+
+// sensitivePatterns returns the default patterns followed by the config ones
+func (c *Config) sensitivePatterns() []string {
+	return append(append([]string{}, DefaultSensitivePatterns...), c.SensitivePatterns...)
+}
+
+// markSensitiveVariables flags the variables and repeat item values whose
+// names match a sensitive pattern
+func (c *Config) markSensitiveVariables() {
+	patterns := c.sensitivePatterns()
+	for i, v := range c.Variables {
+		if IsSensitiveName(v.Name, patterns) {
+			c.Variables[i].Sensitive = true
+		}
+	}
+	for _, include := range c.Include {
+		for i, v := range include.Variables {
+			if IsSensitiveName(v.Name, patterns) {
+				include.Variables[i].Sensitive = true
+			}
+		}
+		walkListItems(include.List, func(item ListItem) error {
+			for i, v := range item.Values {
+				if IsSensitiveName(v.Name, patterns) {
+					item.Values[i].Sensitive = true
+				}
+			}
+			return nil
+		})
+	}
+}
+
+// validateSensitivePatterns checks the glob syntax of the config patterns
+func validateSensitivePatterns(config *Config) error {
+	for _, pattern := range config.SensitivePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid sensitive pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Redact replaces the values of sensitive variables, include variables,
+// repeat item values and the given extra values found in text with MaskedValue
+func (c *Config) Redact(text string, extra ...interface{}) string {
+	// Mask both the declared and the resolved value of sensitive variables
+	raw := make(map[string]interface{}, len(c.Variables))
+	for _, v := range c.Variables {
+		raw[v.Name] = v.Value
+	}
+	resolved, err := ResolveVariableReferences(raw)
+	if err != nil {
+		resolved = raw
+	}
+
+	var secrets []string
+	for _, v := range c.Variables {
+		if v.Sensitive {
+			secrets = appendSecretStrings(secrets, v.Value)
+			secrets = appendSecretStrings(secrets, resolved[v.Name])
+		}
+	}
+	for _, include := range c.Include {
+		for _, v := range include.Variables {
+			if v.Sensitive {
+				secrets = appendSecretStrings(secrets, v.Value)
+			}
+		}
+		walkListItems(include.List, func(item ListItem) error {
+			for _, v := range item.Values {
+				if v.Sensitive {
+					secrets = appendSecretStrings(secrets, v.Value)
+				}
+			}
+			return nil
+		})
+	}
+	for _, value := range extra {
+		secrets = appendSecretStrings(secrets, value)
+	}
+
+	// Replace longer values first so a secret containing another one is fully masked
+	sort.Slice(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	for _, secret := range secrets {
+		text = strings.ReplaceAll(text, secret, MaskedValue)
+	}
+	return text
+}
+
+// RedactError returns err with the sensitive values of its message masked
+func (c *Config) RedactError(err error, extra ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	message := c.Redact(err.Error(), extra...)
+	if message == err.Error() {
+		return err
+	}
+	return &redactedError{message: message, err: err}
+}
+
+// redactedError keeps the original error for errors.Is/As with a masked message
+type redactedError struct {
+	message string
+	err     error
+}
+
+func (e *redactedError) Error() string { return e.message }
+
+func (e *redactedError) Unwrap() error { return e.err }
+
+// appendSecretStrings collects the text forms of a value and of every scalar
+// nested in it
+func appendSecretStrings(secrets []string, value interface{}) []string {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			secrets = appendSecretStrings(secrets, item)
+		}
+	case map[string]interface{}:
+		for _, item := range v {
+			secrets = appendSecretStrings(secrets, item)
+		}
+	}
+
+	if text := FormatVariableValue(value); len(text) >= minRedactLength {
+		secrets = append(secrets, text)
+	}
+	return secrets
+}
@@ -0,0 +1,173 @@
+package mikomanifest
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jepemo/miko-manifest/pkg/output"
+)
+
+func TestIsSensitiveName(t *testing.T) {
+	patterns := append(append([]string{}, DefaultSensitivePatterns...), "api_*")
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"db_password", true},
+		{"DB_PASSWORD", true},
+		{"registry_token", true},
+		{"api_key", true},
+		{"password", false},
+		{"token_ttl", false},
+		{"app_name", false},
+	}
+
+	for _, tt := range tests {
+		if got := IsSensitiveName(tt.name, patterns); got != tt.expected {
+			t.Errorf("IsSensitiveName(%s): expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestSensitivePatternsMarkVariables(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base.yaml", `---
+sensitivePatterns:
+  - "*_key"
+variables:
+  - name: db_password
+    value: hunter22
+  - name: signing_key
+    value: abcd1234
+include:
+  - file: app.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: client_secret
+            value: shh-secret
+`)
+	h.CreateFile("config/dev.yaml", `---
+resources:
+  - base.yaml
+variables:
+  - name: app_name
+    value: my-app
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+	h.AssertNoError(err)
+
+	for name, sensitive := range map[string]bool{"db_password": true, "signing_key": true, "app_name": false} {
+		v, _ := config.FindVariable(name)
+		if v.Sensitive != sensitive {
+			t.Errorf("Variable %s: expected sensitive=%v", name, sensitive)
+		}
+	}
+	if item := config.Include[0].List[0].Values[0]; !item.Sensitive {
+		t.Error("Expected repeat item value client_secret to be sensitive")
+	}
+
+	ApplyVariableOverrides(config, map[string]interface{}{"new_token": "tok-1234"})
+	if v, _ := config.FindVariable("new_token"); !v.Sensitive {
+		t.Error("Expected new override matching a pattern to be sensitive")
+	}
+
+	h.CreateFile("config/bad.yaml", "sensitivePatterns: [\"[\"]\n")
+	_, err = LoadConfig(filepath.Join(h.TempDir(), "config"), "bad", false)
+	h.AssertErrorContains(err, "invalid sensitive pattern")
+}
+
+func TestRedactSensitiveValues(t *testing.T) {
+	config := &Config{
+		Variables: []Variable{
+			{Name: "db_password", Value: "hunter22", Sensitive: true},
+			{Name: "admin_password", Value: "${db_password}-admin", Sensitive: true},
+			{Name: "dsn", Value: "postgres://app:${db_password}@db"},
+			{Name: "app_name", Value: "my-app"},
+		},
+		Include: []Include{{
+			File: "app.yaml",
+			List: []ListItem{{Key: "api", Values: []Variable{{Name: "client_secret", Value: "shh-secret", Sensitive: true}}}},
+		}},
+	}
+
+	message := "render postgres://app:hunter22@db as my-app with hunter22-admin, shh-secret and cli-secret"
+	expected := "render postgres://app:********@db as my-app with ********, ******** and ********"
+	if got := config.Redact(message, "cli-secret"); got != expected {
+		t.Errorf("Expected %q, got %q", expected, got)
+	}
+
+	cause := errors.New("hunter22 rejected")
+	err := config.RedactError(fmt.Errorf("build failed: %w", cause))
+	if strings.Contains(err.Error(), "hunter22") || !errors.Is(err, cause) {
+		t.Errorf("Expected masked error wrapping the cause, got %v", err)
+	}
+}
+
+func TestBuildMasksSensitiveOverrides(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: api_key
+    sensitive: true
+    value: placeholder
+include:
+  - file: app.yaml
+`)
+	h.CreateFile("templates/app.yaml", "key: {{.api_key}}\ntoken: {{.deploy_token}}\n")
+
+	options := h.GetBuildOptions()
+	options.Variables = map[string]interface{}{"api_key": "real-key", "deploy_token": "tok-1234", "replicas": 2}
+	options.OutputOpts = &output.OutputOptions{Verbose: true}
+
+	out := h.CaptureOutput(func() {
+		h.AssertNoError(New(options).Build())
+	})
+
+	h.AssertStringContains(out, "Override variable: api_key="+MaskedValue)
+	h.AssertStringContains(out, "Override variable: deploy_token="+MaskedValue)
+	h.AssertStringContains(out, "Override variable: replicas=2")
+	if strings.Contains(out, "real-key") || strings.Contains(out, "tok-1234") {
+		t.Errorf("Expected sensitive values to be masked, got:\n%s", out)
+	}
+
+	// Values are still rendered into the manifests
+	h.AssertFileContains("output/app.yaml", "key: real-key")
+	h.AssertFileContains("output/app.yaml", "token: tok-1234")
+}
+
+func TestOverridesAreKeptLiterally(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: db_password
+    value: placeholder
+  - name: dsn
+    value: postgres://app:${db_password}@db
+include:
+  - file: app.yaml
+`)
+	h.CreateFile("templates/app.yaml", "password: {{ .db_password }}\ndsn: {{ .dsn }}\n")
+
+	options := h.GetBuildOptions()
+	options.Variables = map[string]interface{}{"db_password": "ab${cd}ef"}
+	h.AssertNoError(New(options).Build())
+	h.AssertFileContains("output/app.yaml", "password: ab${cd}ef\ndsn: postgres://app:ab${cd}ef@db")
+
+	config, err := New(options).LoadConfig("test")
+	h.AssertNoError(err)
+	ApplyVariableOverrides(config, options.Variables)
+	h.AssertNoError(ResolveConfigVariables(config))
+	if v, _ := config.FindVariable("dsn"); v.Value != "postgres://app:ab${cd}ef@db" {
+		t.Errorf("Expected the override to be kept literally, got %v", v.Value)
+	}
+}
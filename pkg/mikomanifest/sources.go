@@ -0,0 +1,165 @@
+package mikomanifest
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// MaskedValue replaces the value of sensitive variables in output
+const MaskedValue = "********"
+
+// UnavailableInputError reports a value the configuration reads from outside
+// that is not available where it is loaded: an unset environment variable, a
+// missing file or age key. The configuration itself may still be valid.
+type UnavailableInputError struct {
+	Err error
+}
+
+func (e *UnavailableInputError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *UnavailableInputError) Unwrap() error {
+	return e.Err
+}
+
+// String describes the source, e.g. "env IMAGE_TAG" or "file secrets/token"
+func (s ValueSource) String() string {
+	switch {
+	case s.Env != "":
+		return fmt.Sprintf("env %s", s.Env)
+	case s.File != "":
+		return fmt.Sprintf("file %s", s.File)
+	case s.FileBase64 != "":
+		return fmt.Sprintf("fileBase64 %s", s.FileBase64)
+	default:
+		return "empty source"
+	}
+}
+
+// DisplayValue returns the variable value formatted for output, masked when
+// the variable is sensitive
+func (v Variable) DisplayValue() string {
+	if v.Sensitive {
+		return MaskedValue
+	}
+	return FormatVariableValue(v.Value)
+}
+
+// walkVariables calls fn for every variable declared by a config: global
+// variables, include variables and repeat item values. Errors are prefixed
+// with the include or item they come from.
+func walkVariables(config *Config, fn func(v *Variable) error) error {
+	for i := range config.Variables {
+		if err := fn(&config.Variables[i]); err != nil {
+			return err
+		}
+	}
+
+	for _, include := range config.Include {
+		for i := range include.Variables {
+			if err := fn(&include.Variables[i]); err != nil {
+				return fmt.Errorf("%s: %w", include.Name(), err)
+			}
+		}
+		err := walkListItems(include.List, func(item ListItem) error {
+			for i := range item.Values {
+				if err := fn(&item.Values[i]); err != nil {
+					return fmt.Errorf("%s[%s]: %w", include.Name(), item.Key, err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindValueSources checks the valueFrom sources declared in a config file and
+// records the file on them, so their paths stay relative to it
+func bindValueSources(config *Config, configPath string) error {
+	return walkVariables(config, func(v *Variable) error {
+		source := v.ValueFrom
+		if source == nil {
+			return nil
+		}
+
+		set := 0
+		for _, field := range []string{source.Env, source.File, source.FileBase64} {
+			if field != "" {
+				set++
+			}
+		}
+		if set != 1 {
+			return fmt.Errorf("variable %s: valueFrom must set exactly one of env, file or fileBase64", v.Name)
+		}
+		if source.Default != nil && source.Env == "" {
+			return fmt.Errorf("variable %s: valueFrom default is only supported with env", v.Name)
+		}
+
+		source.layer = configPath
+		return nil
+	})
+}
+
+// resolveValueSources reads the valueFrom sources left in a merged config.
+// Sources that a later layer replaced with a value are gone by then.
+func resolveValueSources(config *Config) error {
+	return walkVariables(config, func(v *Variable) error {
+		if v.ValueFrom == nil {
+			return nil
+		}
+		if err := resolveValueSource(v); err != nil {
+			return fmt.Errorf("failed to resolve variable sources in %s: %w", v.ValueFrom.layer, err)
+		}
+		return nil
+	})
+}
+
+// resolveValueSource sets the value of a variable from its valueFrom source.
+// The declaration that set the source is the last origin of the variable.
+func resolveValueSource(v *Variable) error {
+	source := v.ValueFrom
+
+	switch {
+	case source.Env != "":
+		raw, found := os.LookupEnv(source.Env)
+		if !found {
+			if source.Default == nil {
+				return &UnavailableInputError{Err: fmt.Errorf("variable %s: environment variable %s is not set", v.Name, source.Env)}
+			}
+			raw = *source.Default
+		}
+		value, err := ParseVariableValue(raw)
+		if err != nil {
+			return fmt.Errorf("variable %s: environment variable %s: %w", v.Name, source.Env, err)
+		}
+		v.Value = escapeReferences(value)
+
+	case source.File != "":
+		data, err := os.ReadFile(resolveRelativePath(source.layer, source.File))
+		if err != nil {
+			return &UnavailableInputError{Err: fmt.Errorf("variable %s: failed to read file: %w", v.Name, err)}
+		}
+		// Drop the final newline most editors add
+		content := strings.TrimSuffix(string(data), "\n")
+		v.Value = escapeReferences(strings.TrimSuffix(content, "\r"))
+
+	case source.FileBase64 != "":
+		data, err := os.ReadFile(resolveRelativePath(source.layer, source.FileBase64))
+		if err != nil {
+			return &UnavailableInputError{Err: fmt.Errorf("variable %s: failed to read file: %w", v.Name, err)}
+		}
+		v.Value = base64.StdEncoding.EncodeToString(data)
+	}
+
+	if len(v.Origins) > 0 {
+		v.Origins[len(v.Origins)-1].Value = v.Value
+	}
+	return nil
+}
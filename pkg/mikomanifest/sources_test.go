@@ -0,0 +1,177 @@
+package mikomanifest
+
+import (
+	"encoding/base64"
+	"path/filepath"
+	"testing"
+)
+
+func TestVariableValueSources(t *testing.T) {
+	h := NewTestHelper(t)
+
+	t.Setenv("MIKO_TEST_TAG", "1.4.2")
+	t.Setenv("MIKO_TEST_REPLICAS", "3")
+
+	h.CreateFile("config/secrets/token", "s3cr3t-${x}\n")
+	h.CreateFile("config/certs/ca.pem", "-----CERT-----\n")
+	h.CreateFile("config/dev.yaml", `---
+variables:
+  - name: tag
+    valueFrom:
+      env: MIKO_TEST_TAG
+  - name: replicas
+    valueFrom:
+      env: MIKO_TEST_REPLICAS
+  - name: region
+    valueFrom:
+      env: MIKO_TEST_UNSET_REGION
+      default: eu-west-1
+  - name: token
+    sensitive: true
+    valueFrom:
+      file: secrets/token
+  - name: ca
+    valueFrom:
+      fileBase64: certs/ca.pem
+include:
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: image_tag
+            valueFrom:
+              env: MIKO_TEST_TAG
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+	h.AssertNoError(err)
+	h.AssertNoError(ResolveConfigVariables(config))
+
+	expected := map[string]interface{}{
+		"tag":      "1.4.2",
+		"replicas": 3,
+		"region":   "eu-west-1",
+		"token":    "s3cr3t-${x}",
+		"ca":       base64.StdEncoding.EncodeToString([]byte("-----CERT-----\n")),
+	}
+	for name, value := range expected {
+		v, found := config.FindVariable(name)
+		if !found {
+			t.Errorf("Expected variable %s to be defined", name)
+			continue
+		}
+		if v.Value != value {
+			t.Errorf("Variable %s: expected %#v, got %#v", name, value, v.Value)
+		}
+	}
+
+	token, _ := config.FindVariable("token")
+	if token.DisplayValue() != MaskedValue {
+		t.Errorf("Expected sensitive token to be masked, got %s", token.DisplayValue())
+	}
+	if token.ValueFrom.String() != "file secrets/token" {
+		t.Errorf("Expected source description 'file secrets/token', got %s", token.ValueFrom)
+	}
+
+	if item := config.Include[0].List[0].Values[0]; item.Value != "1.4.2" {
+		t.Errorf("Expected repeat item value from env, got %#v", item.Value)
+	}
+}
+
+func TestVariableValueSourceErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name: "unset environment variable",
+			config: `variables:
+  - name: tag
+    valueFrom:
+      env: MIKO_TEST_SURELY_UNSET
+`,
+			expected: "environment variable MIKO_TEST_SURELY_UNSET is not set",
+		},
+		{
+			name: "missing file",
+			config: `variables:
+  - name: token
+    valueFrom:
+      file: missing.txt
+`,
+			expected: "variable token: failed to read file",
+		},
+		{
+			name: "several sources",
+			config: `variables:
+  - name: token
+    valueFrom:
+      env: HOME
+      file: token.txt
+`,
+			expected: "must set exactly one of env, file or fileBase64",
+		},
+		{
+			name: "value and valueFrom",
+			config: `variables:
+  - name: token
+    value: x
+    valueFrom:
+      env: HOME
+`,
+			expected: "cannot set both value and valueFrom",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewTestHelper(t)
+			h.CreateFile("config/dev.yaml", tt.config)
+
+			_, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+			h.AssertErrorContains(err, tt.expected)
+		})
+	}
+}
+
+func TestOverriddenValueSourcesAreNotRead(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/base/base.yaml", `variables:
+  - name: image_tag
+    valueFrom:
+      env: MIKO_TEST_SURELY_UNSET
+  - name: token
+    valueFrom:
+      file: secrets/token
+`)
+	h.CreateFile("config/base/secrets/token", "s3cret\n")
+	h.CreateFile("config/dev.yaml", `resources:
+  - base/base.yaml
+variables:
+  - name: image_tag
+    value: latest
+`)
+
+	config, err := LoadConfig(filepath.Join(h.TempDir(), "config"), "dev", false)
+	h.AssertNoError(err)
+
+	tag, _ := config.FindVariable("image_tag")
+	if tag.Value != "latest" || tag.ValueFrom != nil {
+		t.Errorf("Expected the overlay value to win without reading the source, got %#v from %v", tag.Value, tag.ValueFrom)
+	}
+	if origin := tag.Origins[0]; origin.Value != "(from env MIKO_TEST_SURELY_UNSET)" {
+		t.Errorf("Expected the overridden origin to show its source, got %#v", origin.Value)
+	}
+
+	// File paths stay relative to the file declaring the source
+	token, _ := config.FindVariable("token")
+	if token.Value != "s3cret" {
+		t.Errorf("Expected the token read relative to base.yaml, got %#v", token.Value)
+	}
+	if origin := token.Origins[0]; origin.Value != "s3cret" {
+		t.Errorf("Expected the winning origin to hold the value read, got %#v", origin.Value)
+	}
+}
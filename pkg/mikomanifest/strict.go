@@ -0,0 +1,199 @@
+package mikomanifest
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// maxStrictPasses bounds the number of renders used to find every missing key
+// of a single template
+const maxStrictPasses = 100
+
+// missingKeyPattern matches the error text/template returns with missingkey=error
+var missingKeyPattern = regexp.MustCompile(`^template: (.*):(\d+):(\d+): executing ".*" at <(.*)>: map has no entry for key "(.*)"$`)
+
+// MissingKey is a variable used by a template but not defined
+type MissingKey struct {
+	Name string // Variable name, with a dotted path for nested keys ("db.host")
+	File string // Helper file using the variable, empty for the template itself
+	Line int
+	Col  int
+}
+
+// MissingKeyError lists the undefined variables used by one template or repeat item
+type MissingKeyError struct {
+	Template string // Template name, "file[key]" for repeat items
+	Keys     []MissingKey
+}
+
+func (e *MissingKeyError) Error() string {
+	keys := make([]string, 0, len(e.Keys))
+	for _, k := range e.Keys {
+		if k.File != "" {
+			keys = append(keys, fmt.Sprintf("%s (%s line %d)", k.Name, k.File, k.Line))
+		} else {
+			keys = append(keys, fmt.Sprintf("%s (line %d)", k.Name, k.Line))
+		}
+	}
+	return fmt.Sprintf("%s: %s", e.Template, strings.Join(keys, ", "))
+}
+
+// StrictModeError reports every template that uses undefined variables
+type StrictModeError struct {
+	Templates []*MissingKeyError
+}
+
+func (e *StrictModeError) Error() string {
+	count := 0
+	lines := make([]string, 0, len(e.Templates))
+	for _, t := range e.Templates {
+		count += len(t.Keys)
+		lines = append(lines, "  "+t.Error())
+	}
+	return fmt.Sprintf("strict mode found %d undefined variable(s) in %d template(s):\n%s",
+		count, len(e.Templates), strings.Join(lines, "\n"))
+}
+
+// addStrictErrors merges the missing keys reported by err into errs and
+// returns false if err is of another kind
+func addStrictErrors(errs *[]*MissingKeyError, err error) bool {
+	var missing *MissingKeyError
+	if errors.As(err, &missing) {
+		*errs = append(*errs, missing)
+		return true
+	}
+	var strict *StrictModeError
+	if errors.As(err, &strict) {
+		*errs = append(*errs, strict.Templates...)
+		return true
+	}
+	return false
+}
+
+// renderStrict executes a template with missingkey=error. Each time a key is
+// missing it is recorded and replaced by a nil placeholder, and the template
+// is executed again, so every missing key is reported at once.
+func renderStrict(tmpl *template.Template, variables map[string]interface{}, templateName string) (string, error) {
+	tmpl = tmpl.Option("missingkey=error")
+	data := variables
+	copied := false
+	var missing []MissingKey
+	seen := make(map[string]bool)
+
+	for pass := 0; pass < maxStrictPasses; pass++ {
+		var result strings.Builder
+		err := tmpl.Execute(&result, data)
+		if err == nil {
+			if len(missing) == 0 {
+				return result.String(), nil
+			}
+			break
+		}
+
+		// Keys missing inside a helper are reported by the innermost error
+		var execErr template.ExecError
+		if !errors.As(err, &execErr) {
+			return "", fmt.Errorf("failed to execute template %s: %w", templateName, err)
+		}
+		for {
+			var inner template.ExecError
+			if !errors.As(execErr.Err, &inner) {
+				break
+			}
+			execErr = inner
+		}
+		matches := missingKeyPattern.FindStringSubmatch(execErr.Error())
+		if matches == nil {
+			if len(missing) > 0 {
+				// Most likely a placeholder used as a list or map, e.g. by
+				// range or index: the missing keys are the actual problem
+				break
+			}
+			return "", fmt.Errorf("failed to execute template %s: %w", templateName, err)
+		}
+
+		file := matches[1]
+		if file == templateName {
+			file = ""
+		}
+		line, _ := strconv.Atoi(matches[2])
+		col, _ := strconv.Atoi(matches[3])
+		location := matches[1] + ":" + matches[2] + ":" + matches[3]
+		if seen[location] {
+			// The placeholder did not help (e.g. a key missing inside range)
+			break
+		}
+		seen[location] = true
+
+		if !copied {
+			data = copyMaps(variables).(map[string]interface{})
+			copied = true
+		}
+		name, fixed := insertPlaceholder(data, matches[4], matches[5])
+		missing = append(missing, MissingKey{Name: name, File: file, Line: line, Col: col})
+		if !fixed {
+			break
+		}
+	}
+
+	return "", &MissingKeyError{Template: templateName, Keys: missing}
+}
+
+// insertPlaceholder adds a nil value for the missing key of a field chain
+// such as ".db.host" and returns the missing variable path. It returns false
+// if the chain cannot be followed from the top-level variables.
+func insertPlaceholder(data map[string]interface{}, expression, key string) (string, bool) {
+	expression = strings.TrimPrefix(expression, "$")
+	if !strings.HasPrefix(expression, ".") || strings.ContainsAny(expression, " ()|") {
+		return key, false
+	}
+
+	path := strings.Split(expression[1:], ".")
+	current := data
+	for i, segment := range path {
+		value, exists := current[segment]
+		if !exists {
+			if segment != key {
+				return key, false
+			}
+			if i == len(path)-1 {
+				// nil prints, compares and ranges without an error
+				current[segment] = nil
+			} else {
+				current[segment] = map[string]interface{}{}
+			}
+			return strings.Join(path[:i+1], "."), true
+		}
+		next, ok := value.(map[string]interface{})
+		if !ok {
+			return key, false
+		}
+		current = next
+	}
+	return key, false
+}
+
+// copyMaps returns a copy of value where every nested map is copied, so
+// placeholders never reach the caller's variables
+func copyMaps(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			m[k] = copyMaps(item)
+		}
+		return m
+	case []interface{}:
+		list := make([]interface{}, 0, len(v))
+		for _, item := range v {
+			list = append(list, copyMaps(item))
+		}
+		return list
+	default:
+		return value
+	}
+}
@@ -0,0 +1,128 @@
+package mikomanifest
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestRenderTemplateStrict(t *testing.T) {
+	m := New(BuildOptions{Strict: true})
+
+	templateContent := `name: {{.app_name}}
+image: {{.image}}:{{.image_tag}}
+host: {{.db.host}}
+port: {{.db.port}}
+tls: {{.tls.enabled}}`
+
+	variables := map[string]interface{}{
+		"app_name": "my-app",
+		"db":       map[string]interface{}{"host": "db.local"},
+	}
+
+	_, err := m.RenderTemplate(templateContent, variables, "app.yaml")
+	var missing *MissingKeyError
+	if !errors.As(err, &missing) {
+		t.Fatalf("Expected MissingKeyError, got: %v", err)
+	}
+
+	expected := []MissingKey{
+		{Name: "image", Line: 2, Col: 9},
+		{Name: "image_tag", Line: 2, Col: 20},
+		{Name: "db.port", Line: 4, Col: 11},
+		{Name: "tls", Line: 5, Col: 11},
+	}
+	if !reflect.DeepEqual(missing.Keys, expected) {
+		t.Errorf("Expected missing keys %+v, got %+v", expected, missing.Keys)
+	}
+	if _, exists := variables["db"].(map[string]interface{})["port"]; exists {
+		t.Error("Expected placeholders to stay out of the caller's variables")
+	}
+
+	variables["image"] = "nginx"
+	variables["image_tag"] = "1.25"
+	variables["db"].(map[string]interface{})["port"] = 5432
+	variables["tls"] = map[string]interface{}{"enabled": true}
+	result, err := m.RenderTemplate(templateContent, variables, "app.yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+	if !strings.Contains(result, "image: nginx:1.25") {
+		t.Errorf("Unexpected result:\n%s", result)
+	}
+
+	// Keys missing inside range are reported once
+	_, err = m.RenderTemplate("{{range .services}}{{.name}}{{end}}", map[string]interface{}{
+		"services": []interface{}{map[string]interface{}{"port": 80}},
+	}, "services.yaml")
+	if !errors.As(err, &missing) || len(missing.Keys) != 1 || missing.Keys[0].Name != "name" {
+		t.Errorf("Expected a single missing key 'name', got: %v", err)
+	}
+
+	// Placeholders of lists do not hide the missing keys
+	_, err = m.RenderTemplate("{{.image}}\n{{range .ports}}- {{.}}{{end}}\n{{len .hosts}}\n{{.tag}}", map[string]interface{}{}, "ports.yaml")
+	if !errors.As(err, &missing) {
+		t.Fatalf("Expected MissingKeyError, got: %v", err)
+	}
+	names := make([]string, 0, len(missing.Keys))
+	for _, k := range missing.Keys {
+		names = append(names, k.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"image", "ports", "hosts"}) {
+		t.Errorf("Expected missing keys image, ports and hosts, got: %v", err)
+	}
+}
+
+func TestBuildStrictReportsEveryMissingKey(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+strict: true
+variables:
+  - name: app_name
+    value: my-app
+include:
+  - file: deployment.yaml
+  - file: service.yaml
+    repeat: multiple-files
+    list:
+      - key: api
+        values:
+          - name: port
+            value: 80
+      - key: web
+        values:
+          - name: protocol
+            value: TCP
+`)
+	h.CreateFile("templates/deployment.yaml", "name: {{.app_name}}\nimage: {{.image_tag}}\n")
+	h.CreateFile("templates/service.yaml", "name: {{.app_name}}-svc\nport: {{.port}}\n")
+
+	err := New(h.GetBuildOptions()).Build()
+	var strict *StrictModeError
+	if !errors.As(err, &strict) {
+		t.Fatalf("Expected StrictModeError, got: %v", err)
+	}
+	h.AssertErrorContains(err, "strict mode found 2 undefined variable(s) in 2 template(s)")
+	h.AssertErrorContains(err, "deployment.yaml: image_tag (line 2)")
+	h.AssertErrorContains(err, "service.yaml[web]: port (line 2)")
+	if !h.FileExists("output/service-api.yaml") || h.FileExists("output/service-web.yaml") {
+		t.Error("Expected only the complete repeat item to be written")
+	}
+
+	// Without strict mode missing keys render as before
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: app_name
+    value: my-app
+include:
+  - file: deployment.yaml
+`)
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/deployment.yaml", "image: <no value>")
+
+	options := h.GetBuildOptions()
+	options.Strict = true
+	h.AssertErrorContains(New(options).Build(), "deployment.yaml: image_tag (line 2)")
+}
@@ -1,6 +1,7 @@
 package mikomanifest
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -119,6 +120,32 @@ func (h *TestHelper) AssertErrorContains(err error, expectedMessage string) {
 	}
 }
 
+// CaptureOutput runs fn and returns everything it printed to stdout
+func (h *TestHelper) CaptureOutput(fn func()) string {
+	oldStdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		h.t.Fatalf("Failed to create pipe: %v", err)
+	}
+	os.Stdout = w
+
+	done := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r)
+		done <- buf.String()
+	}()
+
+	defer func() {
+		os.Stdout = oldStdout
+	}()
+	fn()
+
+	_ = w.Close()
+	os.Stdout = oldStdout
+	return <-done
+}
+
 // Common test data
 const (
 	ValidDeploymentYAML = `---
@@ -241,7 +268,7 @@ func (h *TestHelper) GetBuildOptions() BuildOptions {
 		OutputDir:    filepath.Join(h.tempDir, "output"),
 		ConfigDir:    filepath.Join(h.tempDir, "config"),
 		TemplatesDir: filepath.Join(h.tempDir, "templates"),
-		Variables:    map[string]string{},
+		Variables:    map[string]interface{}{},
 	}
 }
 
@@ -1,8 +1,10 @@
 package mikomanifest
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"strings"
@@ -71,8 +73,9 @@ type LintOptions struct {
 
 // CheckOptions contains options for checking
 type CheckOptions struct {
-	ConfigDir  string
-	OutputOpts *output.OutputOptions
+	ConfigDir    string
+	Environments []string // Environments to load and check (all detected ones if empty)
+	OutputOpts   *output.OutputOptions
 }
 
 // LintDirectory runs native Go YAML linting and kubernetes validation on a directory
@@ -122,7 +125,7 @@ func LintDirectory(options LintOptions) error {
 	}
 
 	// Run YAML linting
-	yamlLintSuccess := lintYAMLFilesWithOutput(options.Directory, outputOpts)
+	yamlLintSuccess := lintYAMLFilesWithOutput(options.Directory, true, outputOpts)
 
 	// Run Kubernetes validation
 	k8sSuccess := validateKubernetesManifestsWithOutput(options.Directory, schemaRegistry, outputOpts)
@@ -130,9 +133,8 @@ func LintDirectory(options LintOptions) error {
 	// Final comprehensive summary
 	if yamlLintSuccess && k8sSuccess {
 		// Get file count for final summary
-		yamlFiles, _ := filepath.Glob(filepath.Join(options.Directory, "*.yaml"))
-		ymlFiles, _ := filepath.Glob(filepath.Join(options.Directory, "*.yml"))
-		totalFiles := len(yamlFiles) + len(ymlFiles)
+		allFiles, _ := findYAMLFiles(options.Directory, true)
+		totalFiles := len(allFiles)
 
 		outputOpts.PrintSummary(fmt.Sprintf("All validations passed - %d file(s) validated successfully", totalFiles))
 	} else {
@@ -174,20 +176,129 @@ func CheckConfigDirectory(options CheckOptions) error {
 		return fmt.Errorf("%s is not a directory", options.ConfigDir)
 	}
 
-	success := lintYAMLFilesWithOutput(options.ConfigDir, outputOpts)
-
-	if success {
-		outputOpts.PrintSummary("All configuration files validated successfully")
-	} else {
+	success := lintYAMLFilesWithOutput(options.ConfigDir, false, outputOpts)
+	if !success {
 		outputOpts.PrintSummary("Configuration validation failed")
 		return fmt.Errorf("yaml configuration validation failed")
 	}
 
+	if !checkEnvironmentsWithOutput(options.ConfigDir, options.Environments, outputOpts) {
+		outputOpts.PrintSummary("Configuration validation failed")
+		return fmt.Errorf("environment configuration validation failed")
+	}
+
+	outputOpts.PrintSummary("All configuration files validated successfully")
 	return nil
 }
 
-// lintYAMLFilesWithOutput lints YAML files using the new output system
-func lintYAMLFilesWithOutput(directory string, outputOpts *output.OutputOptions) bool {
+// checkEnvironmentsWithOutput loads each environment and reports every
+// variable that does not satisfy its declaration. An environment that cannot
+// be loaded here because an input is unavailable (see UnavailableInputError)
+// is reported as a warning and skipped.
+func checkEnvironmentsWithOutput(configDir string, environments []string, outputOpts *output.OutputOptions) bool {
+	if len(environments) == 0 {
+		detected, err := DetectEnvironments(configDir)
+		if err != nil {
+			outputOpts.PrintError(configDir, fmt.Sprintf("Error detecting environments: %v", err))
+			return false
+		}
+		environments = detected
+	}
+
+	outputOpts.PrintStep(fmt.Sprintf("Checking variable declarations of %d environment(s)", len(environments)))
+
+	valid := true
+	for _, env := range environments {
+		envFile := filepath.Join(configDir, env+".yaml")
+
+		config, err := LoadConfig(configDir, env, false)
+		var unavailable *UnavailableInputError
+		if errors.As(err, &unavailable) {
+			outputOpts.PrintWarning(envFile, fmt.Sprintf("Skipped environment %s, it cannot be loaded here: %v", env, err))
+			continue
+		}
+		if err != nil {
+			outputOpts.PrintError(envFile, fmt.Sprintf("Error loading environment %s: %v", env, err))
+			valid = false
+			continue
+		}
+
+		if len(config.Declare) == 0 {
+			outputOpts.PrintInfo(fmt.Sprintf("Environment %s has no variable declarations", env))
+			continue
+		}
+
+		if err := ResolveConfigVariables(config); err != nil {
+			outputOpts.PrintError(envFile, config.Redact(err.Error()))
+			valid = false
+			continue
+		}
+
+		violations := config.ValidateDeclarations()
+		for _, violation := range violations {
+			outputOpts.PrintError(envFile, violation)
+		}
+		if len(violations) > 0 {
+			valid = false
+			continue
+		}
+		outputOpts.PrintValid(envFile, fmt.Sprintf("%d declared variable(s) satisfied", len(config.Declare)))
+	}
+
+	return valid
+}
+
+// DetectEnvironments returns the environments of a config directory: the
+// top-level YAML files that are not loaded as a resource by another one
+func DetectEnvironments(configDir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(configDir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	resources := make(map[string]bool)
+	var candidates []string
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+			// Not a config file, YAML linting reports syntax errors
+			continue
+		}
+		candidates = append(candidates, file)
+
+		var layer struct {
+			Resources       []string        `yaml:"resources"`
+			ResourceOptions ResourceOptions `yaml:"resourceOptions"`
+		}
+		if err := root.Decode(&layer); err != nil {
+			continue
+		}
+		for _, resource := range layer.Resources {
+			// Broken resources are reported when the config is loaded
+			expanded, _ := expandResource(file, resource, layer.ResourceOptions.Recursive)
+			for _, r := range expanded {
+				resources[filepath.Clean(r)] = true
+			}
+		}
+	}
+
+	var environments []string
+	for _, file := range candidates {
+		if !resources[filepath.Clean(file)] {
+			environments = append(environments, strings.TrimSuffix(filepath.Base(file), ".yaml"))
+		}
+	}
+	return environments, nil
+}
+
+// lintYAMLFilesWithOutput lints YAML files using the new output system.
+// With recursive, the files of every subdirectory are linted too.
+func lintYAMLFilesWithOutput(directory string, recursive bool, outputOpts *output.OutputOptions) bool {
 	outputOpts.PrintStep(fmt.Sprintf("Linting YAML files in %s using native Go YAML parser", directory))
 
 	// Check if directory exists first
@@ -204,20 +315,12 @@ func lintYAMLFilesWithOutput(directory string, outputOpts *output.OutputOptions)
 	}
 
 	// Find YAML files
-	yamlFiles, err := filepath.Glob(filepath.Join(directory, "*.yaml"))
+	allFiles, err := findYAMLFiles(directory, recursive)
 	if err != nil {
 		outputOpts.PrintError(directory, fmt.Sprintf("Error finding YAML files: %v", err))
 		return false
 	}
 
-	ymlFiles, err := filepath.Glob(filepath.Join(directory, "*.yml"))
-	if err != nil {
-		outputOpts.PrintError(directory, fmt.Sprintf("Error finding YML files: %v", err))
-		return false
-	}
-
-	allFiles := append(yamlFiles, ymlFiles...)
-
 	if len(allFiles) == 0 {
 		outputOpts.PrintInfo(fmt.Sprintf("No YAML files found in %s", directory))
 		return true
@@ -297,6 +400,52 @@ func lintYAMLFiles(directory string) bool {
 	return yamlErrors == 0
 }
 
+// findYAMLFiles returns the .yaml files of a directory followed by its .yml
+// files. With recursive, subdirectories are searched too.
+func findYAMLFiles(directory string, recursive bool) ([]string, error) {
+	if !recursive {
+		yamlFiles, err := filepath.Glob(filepath.Join(directory, "*.yaml"))
+		if err != nil {
+			return nil, err
+		}
+		ymlFiles, err := filepath.Glob(filepath.Join(directory, "*.yml"))
+		if err != nil {
+			return nil, err
+		}
+		return append(yamlFiles, ymlFiles...), nil
+	}
+
+	var yamlFiles, ymlFiles []string
+	err := filepath.WalkDir(directory, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		switch filepath.Ext(path) {
+		case ".yaml":
+			yamlFiles = append(yamlFiles, path)
+		case ".yml":
+			ymlFiles = append(ymlFiles, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append(yamlFiles, ymlFiles...), nil
+}
+
+// relativeFileName names a file by its path inside directory in messages
+func relativeFileName(directory, path string) string {
+	rel, err := filepath.Rel(directory, path)
+	if err != nil {
+		return filepath.Base(path)
+	}
+	return filepath.ToSlash(rel)
+}
+
 // lintSingleYAMLFile lints a single YAML file using Go's yaml.v3 library
 // lintSingleYAMLFileWithOutput lints a single YAML file using the new output system
 func validateYAMLStructureWithOutput(parsed interface{}, fileName string, docIndex int, isMultiDoc bool, outputOpts *output.OutputOptions) bool {
@@ -490,21 +639,13 @@ func validateYAMLStructure(parsed interface{}, fileName string, docIndex int, is
 func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *SchemaRegistry, outputOpts *output.OutputOptions) bool {
 	outputOpts.PrintStep(fmt.Sprintf("Validating Kubernetes manifests in %s", directory))
 
-	// Find YAML files
-	yamlFiles, err := filepath.Glob(filepath.Join(directory, "*.yaml"))
+	// Find YAML files in the whole output tree
+	allFiles, err := findYAMLFiles(directory, true)
 	if err != nil {
 		outputOpts.PrintError("File search", fmt.Sprintf("Error finding YAML files: %v", err))
 		return false
 	}
 
-	ymlFiles, err := filepath.Glob(filepath.Join(directory, "*.yml"))
-	if err != nil {
-		outputOpts.PrintError("File search", fmt.Sprintf("Error finding YML files: %v", err))
-		return false
-	}
-
-	allFiles := append(yamlFiles, ymlFiles...)
-
 	if len(allFiles) == 0 {
 		outputOpts.PrintInfo(fmt.Sprintf("No YAML files found in %s for Kubernetes validation", directory))
 		return true
@@ -515,9 +656,10 @@ func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *Sch
 	customResourcesValidated := 0
 
 	for _, yamlFile := range allFiles {
+		fileName := relativeFileName(directory, yamlFile)
 		content, err := os.ReadFile(yamlFile)
 		if err != nil {
-			outputOpts.PrintError(filepath.Base(yamlFile), fmt.Sprintf("Error reading file: %v", err))
+			outputOpts.PrintError(fileName, fmt.Sprintf("Error reading file: %v", err))
 			k8sErrors++
 			continue
 		}
@@ -533,7 +675,7 @@ func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *Sch
 
 			var manifest map[string]interface{}
 			if err := yaml.Unmarshal([]byte(doc), &manifest); err != nil {
-				outputOpts.PrintError(filepath.Base(yamlFile), fmt.Sprintf("YAML parsing error: %v", err))
+				outputOpts.PrintError(fileName, fmt.Sprintf("YAML parsing error: %v", err))
 				k8sErrors++
 				continue
 			}
@@ -547,7 +689,7 @@ func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *Sch
 			kind, hasKind := manifest["kind"]
 
 			if !hasAPIVersion || !hasKind {
-				outputOpts.PrintInfo(fmt.Sprintf("%s - Not a Kubernetes manifest (missing apiVersion/kind)", filepath.Base(yamlFile)))
+				outputOpts.PrintInfo(fmt.Sprintf("%s - Not a Kubernetes manifest (missing apiVersion/kind)", fileName))
 				continue
 			}
 
@@ -562,11 +704,11 @@ func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *Sch
 				if isCustomResource {
 					if err != nil {
 						k8sErrors++
-						outputOpts.PrintError(filepath.Base(yamlFile)+docInfo, fmt.Sprintf("Custom resource validation error: %v", err))
+						outputOpts.PrintError(fileName+docInfo, fmt.Sprintf("Custom resource validation error: %v", err))
 					} else {
 						customResourcesValidated++
 						k8sValidated++
-						outputOpts.PrintValid(filepath.Base(yamlFile)+docInfo, fmt.Sprintf("Valid custom resource %s", kind))
+						outputOpts.PrintValid(fileName+docInfo, fmt.Sprintf("Valid custom resource %s", kind))
 					}
 					continue
 				}
@@ -575,10 +717,10 @@ func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *Sch
 			// Basic validation - check if it's a valid Kubernetes resource
 			if err := validateKubernetesResource(manifest); err != nil {
 				k8sErrors++
-				outputOpts.PrintError(filepath.Base(yamlFile)+docInfo, fmt.Sprintf("Kubernetes validation error: %v", err))
+				outputOpts.PrintError(fileName+docInfo, fmt.Sprintf("Kubernetes validation error: %v", err))
 			} else {
 				k8sValidated++
-				outputOpts.PrintValid(filepath.Base(yamlFile)+docInfo, fmt.Sprintf("Valid %s manifest", kind))
+				outputOpts.PrintValid(fileName+docInfo, fmt.Sprintf("Valid %s manifest", kind))
 			}
 		}
 	}
@@ -597,21 +739,13 @@ func validateKubernetesManifestsWithOutput(directory string, schemaRegistry *Sch
 func validateKubernetesManifests(directory string, schemaRegistry *SchemaRegistry) bool {
 	fmt.Printf("Validating Kubernetes manifests in %s...\n", directory)
 
-	// Find YAML files
-	yamlFiles, err := filepath.Glob(filepath.Join(directory, "*.yaml"))
+	// Find YAML files in the whole output tree
+	allFiles, err := findYAMLFiles(directory, true)
 	if err != nil {
 		fmt.Printf("ERROR: Error finding YAML files: %v\n", err)
 		return false
 	}
 
-	ymlFiles, err := filepath.Glob(filepath.Join(directory, "*.yml"))
-	if err != nil {
-		fmt.Printf("ERROR: Error finding YML files: %v\n", err)
-		return false
-	}
-
-	allFiles := append(yamlFiles, ymlFiles...)
-
 	if len(allFiles) == 0 {
 		fmt.Printf("ℹ No YAML files found in %s for Kubernetes validation\n", directory)
 		return true
@@ -622,9 +756,10 @@ func validateKubernetesManifests(directory string, schemaRegistry *SchemaRegistr
 	customResourcesValidated := 0
 
 	for _, yamlFile := range allFiles {
+		fileName := relativeFileName(directory, yamlFile)
 		content, err := os.ReadFile(yamlFile)
 		if err != nil {
-			fmt.Printf("ERROR: %s - Error reading file: %v\n", filepath.Base(yamlFile), err)
+			fmt.Printf("ERROR: %s - Error reading file: %v\n", fileName, err)
 			k8sErrors++
 			continue
 		}
@@ -640,7 +775,7 @@ func validateKubernetesManifests(directory string, schemaRegistry *SchemaRegistr
 
 			var manifest map[string]interface{}
 			if err := yaml.Unmarshal([]byte(doc), &manifest); err != nil {
-				fmt.Printf("ERROR: %s - YAML parsing error: %v\n", filepath.Base(yamlFile), err)
+				fmt.Printf("ERROR: %s - YAML parsing error: %v\n", fileName, err)
 				k8sErrors++
 				continue
 			}
@@ -654,7 +789,7 @@ func validateKubernetesManifests(directory string, schemaRegistry *SchemaRegistr
 			kind, hasKind := manifest["kind"]
 
 			if !hasAPIVersion || !hasKind {
-				fmt.Printf("ℹ %s - Not a Kubernetes manifest (missing apiVersion/kind)\n", filepath.Base(yamlFile))
+				fmt.Printf("ℹ %s - Not a Kubernetes manifest (missing apiVersion/kind)\n", fileName)
 				continue
 			}
 
@@ -669,11 +804,11 @@ func validateKubernetesManifests(directory string, schemaRegistry *SchemaRegistr
 				if isCustomResource {
 					if err != nil {
 						k8sErrors++
-						fmt.Printf("ERROR: %s%s - Custom resource validation error: %v\n", filepath.Base(yamlFile), docInfo, err)
+						fmt.Printf("ERROR: %s%s - Custom resource validation error: %v\n", fileName, docInfo, err)
 					} else {
 						customResourcesValidated++
 						k8sValidated++
-						fmt.Printf("VALID: %s%s - Valid custom resource %s\n", filepath.Base(yamlFile), docInfo, kind)
+						fmt.Printf("VALID: %s%s - Valid custom resource %s\n", fileName, docInfo, kind)
 					}
 					continue
 				}
@@ -682,10 +817,10 @@ func validateKubernetesManifests(directory string, schemaRegistry *SchemaRegistr
 			// Basic validation - check if it's a valid Kubernetes resource
 			if err := validateKubernetesResource(manifest); err != nil {
 				k8sErrors++
-				fmt.Printf("ERROR: %s%s - Kubernetes validation error: %v\n", filepath.Base(yamlFile), docInfo, err)
+				fmt.Printf("ERROR: %s%s - Kubernetes validation error: %v\n", fileName, docInfo, err)
 			} else {
 				k8sValidated++
-				fmt.Printf("VALID: %s%s - Valid %s manifest\n", filepath.Base(yamlFile), docInfo, kind)
+				fmt.Printf("VALID: %s%s - Valid %s manifest\n", fileName, docInfo, kind)
 			}
 		}
 	}
@@ -0,0 +1,349 @@
+package mikomanifest
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// CommandLineOrigin is the origin file reported for --var overrides
+const CommandLineOrigin = "--var"
+
+// UnmarshalYAML decodes a variable keeping the YAML type of its value
+func (v *Variable) UnmarshalYAML(node *yaml.Node) error {
+	var raw struct {
+		Name      string       `yaml:"name"`
+		Value     yaml.Node    `yaml:"value"`
+		ValueFrom *ValueSource `yaml:"valueFrom"`
+		Sensitive bool         `yaml:"sensitive"`
+		Delete    bool         `yaml:"$delete"`
+	}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+
+	value, err := decodeValue(&raw.Value)
+	if err != nil {
+		return fmt.Errorf("invalid value for variable %s: %w", raw.Name, err)
+	}
+
+	if raw.ValueFrom != nil && raw.Value.Kind != 0 {
+		return fmt.Errorf("line %d: variable %s cannot set both value and valueFrom", node.Line, raw.Name)
+	}
+
+	if raw.Delete && (raw.ValueFrom != nil || raw.Value.Kind != 0) {
+		return fmt.Errorf("line %d: variable %s cannot set a value and $delete", node.Line, raw.Name)
+	}
+
+	v.Name = raw.Name
+	v.Delete = raw.Delete
+	v.Value = value
+	v.ValueFrom = raw.ValueFrom
+	v.Sensitive = raw.Sensitive
+	v.line = node.Line
+	return nil
+}
+
+// String returns the origin as "file:line", or just the file for command line overrides
+func (o VariableOrigin) String() string {
+	if o.Line == 0 {
+		return o.File
+	}
+	return fmt.Sprintf("%s:%d", o.File, o.Line)
+}
+
+// appendOrigins returns a new slice with the origins of both declarations
+func appendOrigins(base, override []VariableOrigin) []VariableOrigin {
+	origins := make([]VariableOrigin, 0, len(base)+len(override))
+	origins = append(origins, base...)
+	return append(origins, override...)
+}
+
+// ApplyVariableOverrides applies command line overrides to a loaded config,
+// recording them in the variable origins. New variables are appended in name
+// order. Like values read by valueFrom, overrides are kept literally.
+func ApplyVariableOverrides(config *Config, overrides map[string]interface{}) {
+	names := make([]string, 0, len(overrides))
+	for name := range overrides {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		value := escapeReferences(overrides[name])
+		origin := VariableOrigin{File: CommandLineOrigin, Value: value}
+
+		found := false
+		for i, v := range config.Variables {
+			if v.Name == name {
+				config.Variables[i].Value = value
+				config.Variables[i].Origins = appendOrigins(v.Origins, []VariableOrigin{origin})
+				found = true
+				break
+			}
+		}
+		if !found {
+			config.Variables = append(config.Variables, Variable{
+				Name:      name,
+				Value:     value,
+				Sensitive: config.IsSensitive(name),
+				Origins:   []VariableOrigin{origin},
+			})
+		}
+	}
+}
+
+// FindVariable returns the merged variable with the given name
+func (c *Config) FindVariable(name string) (*Variable, bool) {
+	for i := range c.Variables {
+		if c.Variables[i].Name == name {
+			return &c.Variables[i], true
+		}
+	}
+	return nil, false
+}
+
+// VariableValues returns the merged variables by name, as templates see them
+func (c *Config) VariableValues() map[string]interface{} {
+	values := make(map[string]interface{}, len(c.Variables))
+	for _, v := range c.Variables {
+		values[v.Name] = v.Value
+	}
+	return values
+}
+
+// DeclaredValues returns the merged variables by name with their references
+// unresolved, even after ResolveConfigVariables. Conditions and repeat items
+// expect these values, as they resolve references themselves.
+func (c *Config) DeclaredValues() map[string]interface{} {
+	if c.declared == nil {
+		return c.VariableValues()
+	}
+	values := make(map[string]interface{}, len(c.declared))
+	for name, value := range c.declared {
+		values[name] = value
+	}
+	return values
+}
+
+// decodeValue converts a YAML node into a plain Go value (string, int, float64,
+// bool, []interface{} or map[string]interface{}).
+// A scalar only keeps its YAML type when that type renders back to exactly the
+// text written in the file, so values like "1.10" or "007" stay strings and
+// render as written. Typed values still equal their text in eq and ne (see
+// equal), but other built-ins such as lt compare them as numbers.
+func decodeValue(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case 0:
+		// Missing value
+		return "", nil
+	case yaml.DocumentNode:
+		if len(node.Content) == 0 {
+			return "", nil
+		}
+		return decodeValue(node.Content[0])
+	case yaml.AliasNode:
+		return decodeValue(node.Alias)
+	case yaml.SequenceNode:
+		list := make([]interface{}, 0, len(node.Content))
+		for _, child := range node.Content {
+			item, err := decodeValue(child)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case yaml.MappingNode:
+		m := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			keyNode := node.Content[i]
+			if keyNode.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: map keys must be scalars", keyNode.Line)
+			}
+			item, err := decodeValue(node.Content[i+1])
+			if err != nil {
+				return nil, err
+			}
+			m[keyNode.Value] = item
+		}
+		return m, nil
+	case yaml.ScalarNode:
+		return decodeScalar(node)
+	default:
+		return nil, fmt.Errorf("line %d: unsupported YAML node", node.Line)
+	}
+}
+
+// decodeScalar resolves a scalar node, falling back to its literal text
+func decodeScalar(node *yaml.Node) (interface{}, error) {
+	if node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return node.Value, nil
+	}
+
+	var typed interface{}
+	if err := node.Decode(&typed); err != nil {
+		return node.Value, nil
+	}
+
+	switch typed.(type) {
+	case int, float64, bool:
+		if fmt.Sprint(typed) == node.Value {
+			return typed, nil
+		}
+	}
+
+	return node.Value, nil
+}
+
+// ParseVariableValue parses a command line variable value.
+// Flow collections ("[80, 443]" or "{cpu: 500m}") become lists and maps,
+// any other text is resolved as a single YAML scalar.
+func ParseVariableValue(raw string) (interface{}, error) {
+	trimmed := strings.TrimSpace(raw)
+	if !strings.HasPrefix(trimmed, "[") && !strings.HasPrefix(trimmed, "{") {
+		return decodeScalar(&yaml.Node{Kind: yaml.ScalarNode, Tag: "", Value: raw})
+	}
+
+	var node yaml.Node
+	if err := yaml.Unmarshal([]byte(trimmed), &node); err != nil {
+		// The value itself is left out as it may be a secret
+		return nil, fmt.Errorf("invalid value: %w", err)
+	}
+	return decodeValue(&node)
+}
+
+// FormatVariableValue renders a variable value on a single line.
+// Scalars are printed as is and collections as JSON, which is also valid
+// input for --var.
+func FormatVariableValue(value interface{}) string {
+	switch value.(type) {
+	case []interface{}, map[string]interface{}:
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Sprint(value)
+		}
+		return string(data)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+const (
+	// ListMergeReplace makes a list from a higher layer replace the inherited one
+	ListMergeReplace = "replace"
+	// ListMergeAppend makes a list from a higher layer extend the inherited one
+	ListMergeAppend = "append"
+
+	// patchKey marks a map (or the first item of a list) with an explicit merge strategy
+	patchKey = "$patch"
+)
+
+// mergeValues merges an override value over a base value.
+// Maps are merged recursively unless they carry "$patch: replace". Lists are
+// replaced or appended according to the layer options, or to a leading
+// "- $patch: <strategy>" item. Any other value replaces the base one.
+// The result never contains "$patch" markers.
+func mergeValues(base, override interface{}, opts MergeOptions) interface{} {
+	switch ov := override.(type) {
+	case map[string]interface{}:
+		baseMap, isMap := base.(map[string]interface{})
+		if ov[patchKey] == ListMergeReplace || !isMap {
+			baseMap = nil
+		}
+
+		result := make(map[string]interface{}, len(baseMap)+len(ov))
+		for k, v := range baseMap {
+			result[k] = v
+		}
+		for k, v := range ov {
+			if k == patchKey {
+				continue
+			}
+			result[k] = mergeValues(baseMap[k], v, opts)
+		}
+		return result
+
+	case []interface{}:
+		strategy, items := listPatch(ov)
+		if strategy == "" {
+			strategy = opts.Lists
+		}
+
+		result := make([]interface{}, 0, len(items))
+		if baseList, ok := base.([]interface{}); ok && strategy == ListMergeAppend {
+			result = append(result, baseList...)
+		}
+		for _, item := range items {
+			result = append(result, mergeValues(nil, item, opts))
+		}
+		return result
+
+	default:
+		return override
+	}
+}
+
+// listPatch extracts a leading "$patch" item from a list
+func listPatch(list []interface{}) (string, []interface{}) {
+	if len(list) == 0 {
+		return "", list
+	}
+	marker, ok := list[0].(map[string]interface{})
+	if !ok || len(marker) != 1 {
+		return "", list
+	}
+	strategy, ok := marker[patchKey].(string)
+	if !ok {
+		return "", list
+	}
+	return strategy, list[1:]
+}
+
+// validateMergeDirectives checks the merge options and "$patch" markers of a config
+func validateMergeDirectives(config *Config) error {
+	switch config.Merge.Lists {
+	case "", ListMergeReplace, ListMergeAppend:
+	default:
+		return fmt.Errorf("unknown list merge strategy %q (expected %s or %s)", config.Merge.Lists, ListMergeReplace, ListMergeAppend)
+	}
+
+	// Include variables and item values are merged the same way
+	return walkVariables(config, func(v *Variable) error {
+		if err := validatePatchMarkers(v.Value); err != nil {
+			return fmt.Errorf("variable %s: %w", v.Name, err)
+		}
+		return nil
+	})
+}
+
+// validatePatchMarkers walks a value looking for unsupported "$patch" markers
+func validatePatchMarkers(value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if patch, ok := v[patchKey]; ok && patch != ListMergeReplace {
+			return fmt.Errorf("unsupported %s value %v for a map (expected %s)", patchKey, patch, ListMergeReplace)
+		}
+		for _, child := range v {
+			if err := validatePatchMarkers(child); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		strategy, items := listPatch(v)
+		switch strategy {
+		case "", ListMergeReplace, ListMergeAppend:
+		default:
+			return fmt.Errorf("unsupported %s value %q for a list (expected %s or %s)", patchKey, strategy, ListMergeReplace, ListMergeAppend)
+		}
+		for _, child := range items {
+			if err := validatePatchMarkers(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
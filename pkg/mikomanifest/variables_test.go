@@ -0,0 +1,310 @@
+package mikomanifest
+
+import (
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestVariableUnmarshalTypedValues(t *testing.T) {
+	content := `variables:
+  - name: app_name
+    value: my-app
+  - name: replicas
+    value: 3
+  - name: debug
+    value: true
+  - name: ratio
+    value: 0.5
+  - name: version
+    value: 1.10
+  - name: quoted
+    value: "3"
+  - name: empty
+  - name: ports
+    value: [80, 443]
+  - name: resources
+    value:
+      limits:
+        cpu: 500m
+        memory: 256Mi
+`
+
+	var config Config
+	if err := yaml.Unmarshal([]byte(content), &config); err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := map[string]interface{}{
+		"app_name": "my-app",
+		"replicas": 3,
+		"debug":    true,
+		"ratio":    0.5,
+		"version":  "1.10",
+		"quoted":   "3",
+		"empty":    "",
+		"ports":    []interface{}{80, 443},
+		"resources": map[string]interface{}{
+			"limits": map[string]interface{}{
+				"cpu":    "500m",
+				"memory": "256Mi",
+			},
+		},
+	}
+
+	for _, v := range config.Variables {
+		if !reflect.DeepEqual(v.Value, expected[v.Name]) {
+			t.Errorf("Variable %s: expected %#v, got %#v", v.Name, expected[v.Name], v.Value)
+		}
+	}
+}
+
+func TestParseVariableValue(t *testing.T) {
+	tests := []struct {
+		raw      string
+		expected interface{}
+	}{
+		{"nginx", "nginx"},
+		{"5", 5},
+		{"false", false},
+		{"007", "007"},
+		{"1.10", "1.10"},
+		{"a,b", "a,b"},
+		{"", ""},
+		{"[80, 443]", []interface{}{80, 443}},
+		{"{cpu: 500m, replicas: 2}", map[string]interface{}{"cpu": "500m", "replicas": 2}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			value, err := ParseVariableValue(tt.raw)
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			if !reflect.DeepEqual(value, tt.expected) {
+				t.Errorf("Expected %#v, got %#v", tt.expected, value)
+			}
+		})
+	}
+
+	if _, err := ParseVariableValue("[80, 443"); err == nil {
+		t.Error("Expected error for malformed list, got nil")
+	}
+}
+
+func TestFormatVariableValue(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected string
+	}{
+		{"my-app", "my-app"},
+		{3, "3"},
+		{true, "true"},
+		{[]interface{}{80, 443}, "[80,443]"},
+		{map[string]interface{}{"b": 2, "a": "x"}, `{"a":"x","b":2}`},
+	}
+
+	for _, tt := range tests {
+		if got := FormatVariableValue(tt.value); got != tt.expected {
+			t.Errorf("Expected %q, got %q", tt.expected, got)
+		}
+	}
+}
+
+func TestRenderTemplateStructuredVariables(t *testing.T) {
+	m := New(BuildOptions{})
+
+	templateContent := `ports:
+{{- range .ports}}
+  - {{.}}
+{{- end}}
+cpu: {{.resources.limits.cpu}}
+{{- if .debug}}
+debug: enabled
+{{- end}}`
+
+	variables := m.MergeVariables([]Variable{
+		{Name: "ports", Value: []interface{}{80, 443}},
+		{Name: "resources", Value: map[string]interface{}{
+			"limits": map[string]interface{}{"cpu": "500m"},
+		}},
+		{Name: "debug", Value: false},
+	}, nil, map[string]interface{}{"debug": true})
+
+	result, err := m.RenderTemplate(templateContent, variables, "test.yaml")
+	if err != nil {
+		t.Fatalf("Expected no error, got: %v", err)
+	}
+
+	expected := `ports:
+  - 80
+  - 443
+cpu: 500m
+debug: enabled`
+
+	if result != expected {
+		t.Errorf("Expected:\n%s\nGot:\n%s", expected, result)
+	}
+}
+
+func TestMergeValues(t *testing.T) {
+	base := map[string]interface{}{
+		"pool": map[string]interface{}{"size": 5, "timeout": "30s"},
+		"tags": []interface{}{"a"},
+		"host": "db.local",
+	}
+
+	tests := []struct {
+		name     string
+		override interface{}
+		opts     MergeOptions
+		expected interface{}
+	}{
+		{
+			name:     "nested map merged recursively",
+			override: map[string]interface{}{"pool": map[string]interface{}{"size": 20}},
+			expected: map[string]interface{}{
+				"pool": map[string]interface{}{"size": 20, "timeout": "30s"},
+				"tags": []interface{}{"a"},
+				"host": "db.local",
+			},
+		},
+		{
+			name: "map replaced with $patch",
+			override: map[string]interface{}{
+				"pool": map[string]interface{}{"$patch": "replace", "size": 20},
+			},
+			expected: map[string]interface{}{
+				"pool": map[string]interface{}{"size": 20},
+				"tags": []interface{}{"a"},
+				"host": "db.local",
+			},
+		},
+		{
+			name:     "lists replaced by default",
+			override: map[string]interface{}{"tags": []interface{}{"b"}},
+			expected: map[string]interface{}{
+				"pool": map[string]interface{}{"size": 5, "timeout": "30s"},
+				"tags": []interface{}{"b"},
+				"host": "db.local",
+			},
+		},
+		{
+			name:     "lists appended by layer option",
+			override: map[string]interface{}{"tags": []interface{}{"b"}},
+			opts:     MergeOptions{Lists: ListMergeAppend},
+			expected: map[string]interface{}{
+				"pool": map[string]interface{}{"size": 5, "timeout": "30s"},
+				"tags": []interface{}{"a", "b"},
+				"host": "db.local",
+			},
+		},
+		{
+			name: "list marker overrides layer option",
+			override: map[string]interface{}{
+				"tags": []interface{}{map[string]interface{}{"$patch": "replace"}, "b"},
+			},
+			opts: MergeOptions{Lists: ListMergeAppend},
+			expected: map[string]interface{}{
+				"pool": map[string]interface{}{"size": 5, "timeout": "30s"},
+				"tags": []interface{}{"b"},
+				"host": "db.local",
+			},
+		},
+		{
+			name:     "scalar replaces map",
+			override: "external",
+			expected: "external",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := mergeValues(base, tt.override, tt.opts)
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Expected %#v, got %#v", tt.expected, result)
+			}
+		})
+	}
+
+	if base["pool"].(map[string]interface{})["size"] != 5 {
+		t.Error("Expected base value to be left untouched")
+	}
+}
+
+func TestValidateMergeDirectives(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{
+			name:   "valid markers",
+			config: Config{Merge: MergeOptions{Lists: ListMergeAppend}, Variables: []Variable{{Name: "db", Value: map[string]interface{}{"$patch": "replace"}}}},
+		},
+		{
+			name:    "unknown list strategy",
+			config:  Config{Merge: MergeOptions{Lists: "merge"}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown map marker",
+			config:  Config{Variables: []Variable{{Name: "db", Value: map[string]interface{}{"$patch": "delete"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown list marker",
+			config:  Config{Variables: []Variable{{Name: "tags", Value: []interface{}{map[string]interface{}{"$patch": "merge"}}}}},
+			wantErr: true,
+		},
+		{
+			name: "unknown marker in item value",
+			config: Config{Include: []Include{{File: "app.yaml", Repeat: "same-file", List: []ListItem{
+				{Key: "a", Values: []Variable{{Name: "tags", Value: []interface{}{map[string]interface{}{"$patch": "apend"}, "x"}}}},
+			}}}},
+			wantErr: true,
+		},
+		{
+			name: "unknown marker in child value",
+			config: Config{Include: []Include{{File: "app.yaml", Repeat: "same-file", List: []ListItem{
+				{Key: "a", Children: []ListItem{{Key: "b", Values: []Variable{{Name: "db", Value: map[string]interface{}{"$patch": "merge"}}}}}},
+			}}}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown marker in include variable",
+			config:  Config{Include: []Include{{File: "app.yaml", Variables: []Variable{{Name: "db", Value: map[string]interface{}{"$patch": "delete"}}}}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMergeDirectives(&tt.config)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Expected error: %v, got: %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestTypedVariablesCompareWithText(t *testing.T) {
+	h := NewTestHelper(t)
+
+	h.CreateFile("config/test.yaml", `---
+variables:
+  - name: replicas
+    value: 3
+  - name: debug
+    value: true
+include:
+  - file: deployment.yaml
+`)
+	h.CreateFile("templates/deployment.yaml", `{{ if eq .replicas "3" }}ha: false{{ end }}
+{{ if ne .debug "false" }}debug: on{{ end }}
+`)
+
+	h.AssertNoError(New(h.GetBuildOptions()).Build())
+	h.AssertFileContains("output/deployment.yaml", "ha: false\ndebug: on")
+}